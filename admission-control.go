@@ -15,13 +15,12 @@ package main
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"time"
 
-	"k8s.io/api/admission/v1beta1"
+	"github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
@@ -42,19 +41,88 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
-// admitFunc is a callback for admission controller logic. Given an AdmissionRequest, it returns the sequence of patch
-// operations to be applied in case of success, or the error that will be shown when the operation is rejected.
-type admitFunc func(*v1beta1.AdmissionRequest) ([]patchOperation, error)
+// admitFunc is a callback for admission controller logic. Given the active config and an admissionRequest, it returns the sequence of patch
+// operations to be applied in case of success, or the error that will be shown when the operation is rejected. Policy
+// violations are returned as a *violationError together with the patches, because a violation only rejects the
+// operation if its rule is enforced. An admitFunc must not have side effects, it is called for server-side dry runs
+// too, see admissionRequest.isDryRun.
+type admitFunc func(*Config, *admissionRequest) ([]patchOperation, error)
 
 // isKubeNamespace checks if the given namespace is a Kubernetes-owned namespace.
 func isKubeNamespace(ns string) bool {
 	return ns == metav1.NamespacePublic || ns == metav1.NamespaceSystem
 }
 
+// verdict is the decision on one request, as evaluateRequest makes it for the webhook and the offline commands.
+type verdict struct {
+	decision string
+	// violations are every violation found, whatever the mode of its rule
+	violations []violation
+	// patchOps is the patch for the apiserver, it is empty if the object is not allowed
+	patchOps []patchOperation
+	// warnings are the warned violations for the client
+	warnings []string
+	// denial carries the enforced violations of a denied object
+	denial *violationError
+	// err is the error of a request that could not be evaluated
+	err error
+}
+
+// evaluateRequest decides the request: it runs the admitFunc, applies the rule modes of the namespace and verifies the
+// patch. The decision is not recorded.
+func evaluateRequest(cfg *Config, admit admitFunc, req *admissionRequest) verdict {
+	v := verdict{decision: decisionAllowed}
+	var err error
+	// Apply the admit() function only for non-Kubernetes namespaces. For objects in Kubernetes namespaces, return
+	// an empty set of patch operations.
+	if !isKubeNamespace(req.Namespace) {
+		v.patchOps, err = admit(cfg, req)
+	}
+
+	// Keep every violation for the decision record, applyRuleModes only passes on the enforced ones.
+	if verr, ok := err.(*violationError); ok {
+		v.violations = verr.violations
+	}
+
+	// Only enforced rule violations deny the object, warned violations are passed back to the client.
+	v.warnings, err = applyRuleModes(cfg, req, err)
+
+	// An admitted object is only mutated with a patch that applies and keeps it compliant, otherwise the request fails
+	// closed.
+	if err == nil && len(v.patchOps) > 0 {
+		err = verifyPatch(cfg, req, v.patchOps)
+	}
+
+	if err != nil {
+		v.patchOps = nil
+		if verr, ok := err.(*violationError); ok {
+			v.decision = decisionDenied
+			v.denial = verr
+		} else {
+			v.decision = decisionError
+			v.err = err
+		}
+	}
+	return v
+}
+
+// admissionOutcome is what doServeAdmitFunc decided about a request. serveAdmitFunc records it once per request, in the
+// metrics and as the decision log record.
+type admissionOutcome struct {
+	// req is nil if the AdmissionReview could not be decoded
+	req        *admissionRequest
+	cfg        *Config
+	prefix     string
+	decision   string
+	violations []violation
+	// patchOps is the patch returned to the apiserver, it is empty if the object was denied
+	patchOps []patchOperation
+}
+
 // doServeAdmitFunc parses the HTTP request for an admission controller webhook, and -- in case of a well-formed
 // request -- delegates the admission control logic to the given admitFunc. The response body is then returned as raw
-// bytes.
-func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) ([]byte, error) {
+// bytes, and the decision is recorded in out.
+func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc, out *admissionOutcome) ([]byte, error) {
 	// Step 1: Request validation. Only handle POST requests with a body and json content type.
 
 	if r.Method != http.MethodPost {
@@ -73,76 +141,166 @@ func doServeAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) (
 		return nil, fmt.Errorf("unsupported content type %s, only %s is supported", contentType, jsonContentType)
 	}
 
-	// Step 2: Parse the AdmissionReview request.
-
-	var admissionReviewReq v1beta1.AdmissionReview
+	// Step 2: Parse the AdmissionReview request, remembering which version it was sent in.
 
-	if _, _, err := universalDeserializer.Decode(body, nil, &admissionReviewReq); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		return nil, fmt.Errorf("could not deserialize request: %v", err)
-	} else if admissionReviewReq.Request == nil {
+	apiVersion, admissionReq, err := decodeAdmissionReview(body)
+	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
-		return nil, errors.New("malformed admission review: request is nil")
+		return nil, err
 	}
+	admissionReq.log = requestLogger(r.URL.Path, admissionReq)
+	out.req = admissionReq
 
 	// Step 3: Construct the AdmissionReview response.
 
-	admissionReviewResponse := v1beta1.AdmissionReview{
-		Response: &v1beta1.AdmissionResponse{
-			UID: admissionReviewReq.Request.UID,
-		},
+	admissionResp := &admissionResponse{
+		UID: admissionReq.UID,
 	}
 
-	var patchOps []patchOperation
-	// Apply the admit() function only for non-Kubernetes namespaces. For objects in Kubernetes namespaces, return
-	// an empty set of patch operations.
-	if !isKubeNamespace(admissionReviewReq.Request.Namespace) {
-		patchOps, err = admit(admissionReviewReq.Request)
-	}
+	// Evaluate the whole request against one config snapshot, a reload must not change the policy half way through.
+	cfg := loadedConfig()
+	out.cfg = cfg
+	out.prefix = cfg.namespacePrefix(admissionReq.Namespace)
 
-	if err != nil {
+	v := evaluateRequest(cfg, admit, admissionReq)
+	out.violations = v.violations
+	admissionResp.Warnings = v.warnings
+
+	switch v.decision {
+	case decisionDenied:
+		// Policy violations are reported with one cause per failed check.
+		admissionResp.Result = v.denial.status()
+	case decisionError:
 		// If the handler returned an error, incorporate the error message into the response and deny the object
 		// creation.
-		admissionReviewResponse.Response.Allowed = false
-		admissionReviewResponse.Response.Result = &metav1.Status{
-			Message: err.Error(),
+		admissionReq.log.WithError(v.err).Error("Could not evaluate object")
+		admissionResp.Result = &metav1.Status{
+			Message: v.err.Error(),
 		}
-	} else {
+	default:
 		// Otherwise, encode the patch operations to JSON and return a positive response.
-		patchBytes, err := json.Marshal(patchOps)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
+		admissionResp.Allowed = true
+		if len(v.patchOps) > 0 {
+			patchBytes, err := json.Marshal(v.patchOps)
+			if err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				return nil, fmt.Errorf("could not marshal JSON patch: %v", err)
+			}
+			admissionResp.Patch = patchBytes
 		}
-		admissionReviewResponse.Response.Allowed = true
-		admissionReviewResponse.Response.Patch = patchBytes
 	}
 
-	// Return the AdmissionReview with a response as JSON.
-	bytes, err := json.Marshal(&admissionReviewResponse)
+	// Return the AdmissionReview with a response as JSON, in the same version as the request.
+	bytes, err := encodeAdmissionReview(apiVersion, admissionResp)
 	if err != nil {
 		return nil, fmt.Errorf("marshaling response: %v", err)
 	}
+	out.decision = v.decision
+	out.patchOps = v.patchOps
 	return bytes, nil
 }
 
-// serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling and logging.
+// serveAdmitFunc is a wrapper around doServeAdmitFunc that adds error handling, logging and metrics.
 func serveAdmitFunc(w http.ResponseWriter, r *http.Request, admit admitFunc) {
-	log.Print("Handling webhook request ...")
+	start := time.Now()
+	// a request that fails before the decision is made is recorded as an error
+	out := &admissionOutcome{decision: decisionError}
 
 	var writeErr error
-	if bytes, err := doServeAdmitFunc(w, r, admit); err != nil {
-		log.Printf("Error handling webhook request: %v", err)
+	bytes, err := doServeAdmitFunc(w, r, admit, out)
+	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		_, writeErr = w.Write([]byte(err.Error()))
 	} else {
-		log.Print("Webhook request handled successfully")
 		_, writeErr = w.Write(bytes)
 	}
 
+	out.record(r.URL.Path, time.Since(start), err)
 	if writeErr != nil {
-		log.Printf("Could not write response: %v", writeErr)
+		out.log(r.URL.Path).WithError(writeErr).Error("Could not write response")
+	}
+}
+
+// log returns the entry to log about the request with, it only carries the endpoint if the review was not decoded.
+func (o *admissionOutcome) log(endpoint string) *logrus.Entry {
+	if o.req != nil && o.req.log != nil {
+		return o.req.log
+	}
+	return logger.WithField("endpoint", endpoint)
+}
+
+// record writes the decision log record and audit record and updates the metrics, err is the error that failed the
+// request, if any.
+func (o *admissionOutcome) record(endpoint string, latency time.Duration, err error) {
+	kind := ""
+	if o.req != nil {
+		kind = o.req.Kind.Kind
+	}
+	requestDuration.WithLabelValues(endpoint, kind).Observe(latency.Seconds())
+	if o.req != nil && o.req.isDryRun() {
+		// dry runs are counted on their own, so that the request, violation and patch counters only show what was
+		// admitted
+		dryRunRequestsTotal.WithLabelValues(endpoint, kind, o.decision, o.prefix).Inc()
+	} else {
+		observeAdmission(endpoint, kind, o.prefix, o.decision, o.violations, len(o.patchOps))
+	}
+	if o.req != nil {
+		auditTrail.record(o.auditRecord(endpoint, err))
+	}
+
+	// every rule that was hit, once, in evaluation order
+	rules := []string{}
+	seen := map[string]bool{}
+	for _, v := range o.violations {
+		if !seen[v.Rule] {
+			seen[v.Rule] = true
+			rules = append(rules, v.Rule)
+		}
+	}
+	entry := o.log(endpoint).WithFields(logrus.Fields{
+		"decision":   o.decision,
+		"allowed":    o.decision == decisionAllowed,
+		"rules":      rules,
+		"patches":    len(o.patchOps),
+		"latency_ms": float64(latency.Microseconds()) / 1000,
+	})
+	if err != nil {
+		entry.WithError(err).Error("Admission request failed")
+		return
+	}
+	entry.Info("Admission decision")
+}
+
+// auditRecord returns the audit record of a decoded request.
+func (o *admissionOutcome) auditRecord(endpoint string, err error) *auditRecord {
+	r := &auditRecord{
+		Timestamp:     time.Now().UTC(),
+		UID:           o.req.UID,
+		User:          o.req.UserInfo.Username,
+		Groups:        o.req.UserInfo.Groups,
+		Endpoint:      endpoint,
+		Kind:          o.req.Kind.Kind,
+		Namespace:     o.req.Namespace,
+		Name:          o.req.Name,
+		Operation:     o.req.Operation,
+		DryRun:        o.req.isDryRun(),
+		Decision:      o.decision,
+		Allowed:       o.decision == decisionAllowed,
+		Violations:    o.violations,
+		ConfigVersion: o.cfg.version,
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if len(o.patchOps) > 0 {
+		// the patch can carry env values, it is stored redacted like it is logged
+		if b, err := json.Marshal(o.patchOps); err == nil {
+			if b, err = o.cfg.redactObject(b); err == nil {
+				r.Patch = b
+			}
+		}
 	}
+	return r
 }
 
 // admitFuncHandler takes an admitFunc and wraps it into a http.Handler by means of calling serveAdmitFunc.
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	admissionReviewKind     = "AdmissionReview"
+	admissionV1APIVersion   = "admission.k8s.io/v1"
+	admissionV1beta1Version = "admission.k8s.io/v1beta1"
+)
+
+// the operations the webhook is registered for, see k8s/admit-mwhc.yml
+const (
+	operationCreate = "CREATE"
+	operationUpdate = "UPDATE"
+)
+
+// admissionRequest is a version-neutral copy of an AdmissionRequest. The admission.k8s.io v1 and v1beta1 requests carry
+// the same fields, so handlers are written against this type and doServeAdmitFunc converts from whichever version the
+// apiserver sent.
+type admissionRequest struct {
+	UID         types.UID
+	Kind        metav1.GroupVersionKind
+	Resource    metav1.GroupVersionResource
+	SubResource string
+	Name        string
+	Namespace   string
+	Operation   string
+	UserInfo    authenticationv1.UserInfo
+	Object      runtime.RawExtension
+	OldObject   runtime.RawExtension
+	DryRun      *bool
+
+	// log carries the fields identifying the request, every line about the request is logged through it
+	log *logrus.Entry
+}
+
+// isDryRun reports whether the request is a server-side dry run, whose object is never persisted. A dry run must not
+// have side effects beyond the response, the webhook configurations declare sideEffects: NoneOnDryRun.
+func (r *admissionRequest) isDryRun() bool {
+	return r.DryRun != nil && *r.DryRun
+}
+
+// admissionResponse is the version-neutral counterpart of an AdmissionResponse.
+type admissionResponse struct {
+	UID      types.UID
+	Allowed  bool
+	Result   *metav1.Status
+	Patch    []byte
+	Warnings []string
+}
+
+// decodeAdmissionReview parses an AdmissionReview of any supported version. It returns the apiVersion the review was
+// sent in, so that the response can be encoded in the same version.
+func decodeAdmissionReview(body []byte) (string, *admissionRequest, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(body, &typeMeta); err != nil {
+		return "", nil, fmt.Errorf("could not deserialize request: %v", err)
+	}
+
+	switch typeMeta.APIVersion {
+	case admissionV1APIVersion:
+		var review admissionv1.AdmissionReview
+		if _, _, err := universalDeserializer.Decode(body, nil, &review); err != nil {
+			return "", nil, fmt.Errorf("could not deserialize request: %v", err)
+		} else if review.Request == nil {
+			return "", nil, errors.New("malformed admission review: request is nil")
+		}
+		req := review.Request
+		return typeMeta.APIVersion, &admissionRequest{
+			UID:         req.UID,
+			Kind:        req.Kind,
+			Resource:    req.Resource,
+			SubResource: req.SubResource,
+			Name:        req.Name,
+			Namespace:   req.Namespace,
+			Operation:   string(req.Operation),
+			UserInfo:    req.UserInfo,
+			Object:      req.Object,
+			OldObject:   req.OldObject,
+			DryRun:      req.DryRun,
+		}, nil
+	case admissionV1beta1Version, "":
+		// apiservers that predate admission.k8s.io/v1 always send v1beta1, treat a missing apiVersion the same way.
+		var review v1beta1.AdmissionReview
+		if _, _, err := universalDeserializer.Decode(body, nil, &review); err != nil {
+			return "", nil, fmt.Errorf("could not deserialize request: %v", err)
+		} else if review.Request == nil {
+			return "", nil, errors.New("malformed admission review: request is nil")
+		}
+		req := review.Request
+		return admissionV1beta1Version, &admissionRequest{
+			UID:         req.UID,
+			Kind:        req.Kind,
+			Resource:    req.Resource,
+			SubResource: req.SubResource,
+			Name:        req.Name,
+			Namespace:   req.Namespace,
+			Operation:   string(req.Operation),
+			UserInfo:    req.UserInfo,
+			Object:      req.Object,
+			OldObject:   req.OldObject,
+			DryRun:      req.DryRun,
+		}, nil
+	default:
+		return "", nil, fmt.Errorf("unsupported admission review version %s", typeMeta.APIVersion)
+	}
+}
+
+// encodeAdmissionReview wraps the response in an AdmissionReview of the given apiVersion and returns it as JSON.
+func encodeAdmissionReview(apiVersion string, resp *admissionResponse) ([]byte, error) {
+	switch apiVersion {
+	case admissionV1APIVersion:
+		review := admissionv1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: admissionReviewKind},
+			Response: &admissionv1.AdmissionResponse{
+				UID:      resp.UID,
+				Allowed:  resp.Allowed,
+				Result:   resp.Result,
+				Warnings: resp.Warnings,
+			},
+		}
+		// v1 requires the patch type to be set whenever a patch is returned.
+		if len(resp.Patch) > 0 {
+			patchType := admissionv1.PatchTypeJSONPatch
+			review.Response.Patch = resp.Patch
+			review.Response.PatchType = &patchType
+		}
+		return json.Marshal(&review)
+	case admissionV1beta1Version:
+		review := v1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{APIVersion: apiVersion, Kind: admissionReviewKind},
+			Response: &v1beta1.AdmissionResponse{
+				UID:      resp.UID,
+				Allowed:  resp.Allowed,
+				Result:   resp.Result,
+				Warnings: resp.Warnings,
+			},
+		}
+		if len(resp.Patch) > 0 {
+			patchType := v1beta1.PatchTypeJSONPatch
+			review.Response.Patch = resp.Patch
+			review.Response.PatchType = &patchType
+		}
+		return json.Marshal(&review)
+	default:
+		return nil, fmt.Errorf("unsupported admission review version %s", apiVersion)
+	}
+}
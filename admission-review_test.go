@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeAdmissionReview(t *testing.T) {
+	const request = `"request":{"uid":"u1","kind":{"group":"apps","version":"v1","kind":"Deployment"},
+		"resource":{"group":"apps","version":"v1","resource":"deployments"},"name":"api","namespace":"tools-dev",
+		"operation":"UPDATE","userInfo":{"username":"bob"},"object":{"kind":"Deployment"},"oldObject":{"kind":"Deployment"},"dryRun":true}`
+	tests := []struct {
+		name           string
+		review         string
+		wantAPIVersion string
+		wantErr        string
+	}{
+		{
+			name:           "v1",
+			review:         `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview",` + request + `}`,
+			wantAPIVersion: admissionV1APIVersion,
+		},
+		{
+			name:           "v1beta1",
+			review:         `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview",` + request + `}`,
+			wantAPIVersion: admissionV1beta1Version,
+		},
+		{
+			name:           "missing apiVersion is v1beta1",
+			review:         `{` + request + `}`,
+			wantAPIVersion: admissionV1beta1Version,
+		},
+		{
+			name:    "unsupported version",
+			review:  `{"apiVersion":"admission.k8s.io/v2","kind":"AdmissionReview",` + request + `}`,
+			wantErr: "unsupported admission review version",
+		},
+		{
+			name:    "missing request",
+			review:  `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+			wantErr: "request is nil",
+		},
+		{
+			name:    "not json",
+			review:  `admission`,
+			wantErr: "could not deserialize request",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiVersion, req, err := decodeAdmissionReview([]byte(tt.review))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if apiVersion != tt.wantAPIVersion {
+				t.Errorf("got apiVersion %v, want %v", apiVersion, tt.wantAPIVersion)
+			}
+			if req.UID != "u1" || req.Kind.Kind != "Deployment" || req.Resource.Resource != "deployments" ||
+				req.Name != "api" || req.Namespace != "tools-dev" || req.Operation != operationUpdate ||
+				req.UserInfo.Username != "bob" || !req.isDryRun() {
+				t.Errorf("got request %+v", req)
+			}
+			if string(req.Object.Raw) != `{"kind":"Deployment"}` || string(req.OldObject.Raw) != `{"kind":"Deployment"}` {
+				t.Errorf("got object %s and old object %s", req.Object.Raw, req.OldObject.Raw)
+			}
+		})
+	}
+}
+
+func TestEncodeAdmissionReview(t *testing.T) {
+	patch := []byte(`[{"op":"add","path":"/metadata/labels","value":{"svc":"api"}}]`)
+	tests := []struct {
+		name          string
+		apiVersion    string
+		resp          *admissionResponse
+		wantPatchType string
+		wantErr       bool
+	}{
+		{
+			name:          "v1 with patch and warnings",
+			apiVersion:    admissionV1APIVersion,
+			resp:          &admissionResponse{UID: "u1", Allowed: true, Patch: patch, Warnings: []string{"deployment api: warned"}},
+			wantPatchType: "JSONPatch",
+		},
+		{
+			name:       "v1 without patch",
+			apiVersion: admissionV1APIVersion,
+			resp:       &admissionResponse{UID: "u1", Allowed: true},
+		},
+		{
+			name:          "v1beta1 with patch and warnings",
+			apiVersion:    admissionV1beta1Version,
+			resp:          &admissionResponse{UID: "u1", Allowed: true, Patch: patch, Warnings: []string{"deployment api: warned"}},
+			wantPatchType: "JSONPatch",
+		},
+		{
+			name:       "v1beta1 without patch",
+			apiVersion: admissionV1beta1Version,
+			resp:       &admissionResponse{UID: "u1", Allowed: true},
+		},
+		{
+			name:       "unsupported version",
+			apiVersion: "admission.k8s.io/v2",
+			resp:       &admissionResponse{UID: "u1"},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := encodeAdmissionReview(tt.apiVersion, tt.resp)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			var review struct {
+				APIVersion string `json:"apiVersion"`
+				Kind       string `json:"kind"`
+				Response   struct {
+					UID       string   `json:"uid"`
+					Allowed   bool     `json:"allowed"`
+					Patch     []byte   `json:"patch"`
+					PatchType *string  `json:"patchType"`
+					Warnings  []string `json:"warnings"`
+				} `json:"response"`
+			}
+			if err := json.Unmarshal(b, &review); err != nil {
+				t.Fatal(err)
+			}
+			if review.APIVersion != tt.apiVersion || review.Kind != admissionReviewKind {
+				t.Errorf("got %v %v, want %v %v", review.APIVersion, review.Kind, tt.apiVersion, admissionReviewKind)
+			}
+			r := review.Response
+			if r.UID != string(tt.resp.UID) || r.Allowed != tt.resp.Allowed {
+				t.Errorf("got uid %v allowed %v, want %v %v", r.UID, r.Allowed, tt.resp.UID, tt.resp.Allowed)
+			}
+			if string(r.Patch) != string(tt.resp.Patch) {
+				t.Errorf("got patch %s, want %s", r.Patch, tt.resp.Patch)
+			}
+			// v1 rejects a patch without a patchType, a patchType without a patch is not sent either
+			patchType := ""
+			if r.PatchType != nil {
+				patchType = *r.PatchType
+			}
+			if patchType != tt.wantPatchType {
+				t.Errorf("got patchType %q, want %q", patchType, tt.wantPatchType)
+			}
+			if !reflect.DeepEqual(r.Warnings, tt.resp.Warnings) {
+				t.Errorf("got warnings %v, want %v", r.Warnings, tt.resp.Warnings)
+			}
+		})
+	}
+}
+
+func TestAdmissionReviewRoundTrip(t *testing.T) {
+	for _, apiVersion := range []string{admissionV1APIVersion, admissionV1beta1Version} {
+		t.Run(apiVersion, func(t *testing.T) {
+			review := `{"apiVersion":"` + apiVersion + `","kind":"AdmissionReview","request":{"uid":"u1",
+				"kind":{"group":"","version":"v1","kind":"Pod"},"resource":{"group":"","version":"v1","resource":"pods"},
+				"namespace":"tools-dev","operation":"CREATE","userInfo":{},"object":{}}}`
+			gotVersion, req, err := decodeAdmissionReview([]byte(review))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := encodeAdmissionReview(gotVersion, &admissionResponse{UID: req.UID, Allowed: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the response is sent in the version of the request, with the request's uid
+			var resp struct {
+				APIVersion string `json:"apiVersion"`
+				Response   struct {
+					UID string `json:"uid"`
+				} `json:"response"`
+			}
+			if err := json.Unmarshal(b, &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.APIVersion != apiVersion || resp.Response.UID != "u1" {
+				t.Errorf("got %s", b)
+			}
+		})
+	}
+}
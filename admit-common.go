@@ -1,29 +1,80 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
-	"log"
-	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // match logic is namespace starts with (has prefix of)
-func namespaceIsMonitored(ns string) bool {
-	for _, monitorNs := range config.MonitorNamespaces {
-		if strings.HasPrefix(ns, monitorNs) {
-			return true
-		}
+func (c *Config) namespaceIsMonitored(ns string) bool {
+	_, ok := c.compiled().monitorNamespaces.longestPrefix(ns)
+	return ok
+}
+
+// decodeOldObject decodes the object as it was before an UPDATE into into. It returns false for every other operation,
+// which carry no old object.
+func decodeOldObject(req *admissionRequest, into runtime.Object) (bool, error) {
+	if req.Operation != operationUpdate || len(req.OldObject.Raw) == 0 {
+		return false, nil
+	}
+	if _, _, err := universalDeserializer.Decode(req.OldObject.Raw, nil, into); err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
-	return false
+// checkLabelUnchanged records a violation if the label was set on the old object and was changed or removed by the
+// update.
+func checkLabelUnchanged(old map[string]string, labels map[string]string, key string, v *violations) {
+	oldValue, ok := old[key]
+	if !ok {
+		return
+	}
+	field := "metadata.labels." + key
+	if value, ok := labels[key]; !ok {
+		v.invalid(field, "%v: %v cannot be removed once set", field, oldValue)
+	} else if value != oldValue {
+		v.invalid(field, "%v: %v cannot be changed to %v once set", field, oldValue, value)
+	}
 }
 
-func logReq(body []byte) {
-	var prettyJSON bytes.Buffer
-	err := json.Indent(&prettyJSON, body, "", "  ")
+// logReq logs the object of the request with sensitive values redacted, if object logging is switched on
+func logReq(cfg *Config, req *admissionRequest) {
+	if !cfg.Logging.LogObjects {
+		return
+	}
+	redacted, err := cfg.redactObject(req.Object.Raw)
 	if err != nil {
-		log.Println("could not pretty print JSON error: ", err)
+		// never fall back to logging the object unredacted
+		req.log.WithError(err).Warn("could not redact object, not logging it")
 		return
 	}
-	log.Println(string(prettyJSON.Bytes()))
+	req.log.WithField("object", string(redacted)).Info("Admission object")
+}
+
+// logPatches logs the patch operations with sensitive values redacted, if object logging is switched on
+func logPatches(cfg *Config, req *admissionRequest, patches []patchOperation) {
+	if !cfg.Logging.LogObjects {
+		return
+	}
+	b, err := json.Marshal(patches)
+	if err == nil {
+		b, err = cfg.redactObject(b)
+	}
+	if err != nil {
+		req.log.WithError(err).Warn("could not redact patch, not logging it")
+		return
+	}
+	req.log.WithField("patch", string(b)).Info("Admission patch")
+}
+
+// containsString reports whether s is one of the values in list.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUpdateImmutability(t *testing.T) {
+	cfg := &Config{MonitorNamespaces: []string{"tools-"}}
+	const deployment = `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"api","namespace":"tools-dev"%v},
+		"spec":{"selector":{"matchLabels":{"svc":"api"}},"template":{"metadata":{"labels":{"svc":"api"}},
+		"spec":{"containers":[{"name":"app","image":"alpine:3.12"}]}}}}`
+	const service = `{"apiVersion":"v1","kind":"Service","metadata":{"name":"api","namespace":"tools-dev"%v},
+		"spec":{"selector":{"svc":"api"},"ports":[{"port":80}]}}`
+	const ingress = `{"apiVersion":"networking.k8s.io/v1beta1","kind":"Ingress","metadata":{"name":"api","namespace":"tools-dev"},
+		"spec":{"rules":[{"host":%q,"http":{"paths":[{"path":"/tools-dev/api/","backend":{"serviceName":"api","servicePort":80}}]}}]}}`
+	deploymentKind := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	serviceKind := metav1.GroupVersionKind{Version: "v1", Kind: "Service"}
+	ingressKind := metav1.GroupVersionKind{Group: "networking.k8s.io", Version: "v1beta1", Kind: "Ingress"}
+	tests := []struct {
+		name     string
+		kind     metav1.GroupVersionKind
+		rule     string
+		old, obj string
+		// operation is UPDATE unless set
+		operation string
+		want      bool
+	}{
+		{
+			name: "deployment svc label unchanged",
+			kind: deploymentKind,
+			rule: ruleDeploySvcImmutable,
+			old:  fmt.Sprintf(deployment, `,"labels":{"svc":"api"}`),
+			obj:  fmt.Sprintf(deployment, `,"labels":{"svc":"api"}`),
+		},
+		{
+			name: "deployment svc label changed",
+			kind: deploymentKind,
+			rule: ruleDeploySvcImmutable,
+			old:  fmt.Sprintf(deployment, `,"labels":{"svc":"api"}`),
+			obj:  fmt.Sprintf(deployment, `,"labels":{"svc":"web"}`),
+			want: true,
+		},
+		{
+			name: "deployment svc label removed",
+			kind: deploymentKind,
+			rule: ruleDeploySvcImmutable,
+			old:  fmt.Sprintf(deployment, `,"labels":{"svc":"api"}`),
+			obj:  fmt.Sprintf(deployment, ``),
+			want: true,
+		},
+		{
+			name: "deployment svc label added",
+			kind: deploymentKind,
+			rule: ruleDeploySvcImmutable,
+			old:  fmt.Sprintf(deployment, ``),
+			obj:  fmt.Sprintf(deployment, `,"labels":{"svc":"api"}`),
+		},
+		{
+			name:      "deployment create has no old object",
+			kind:      deploymentKind,
+			rule:      ruleDeploySvcImmutable,
+			obj:       fmt.Sprintf(deployment, `,"labels":{"svc":"web"}`),
+			operation: operationCreate,
+		},
+		{
+			name: "service svc label changed",
+			kind: serviceKind,
+			rule: ruleSvcSvcImmutable,
+			old:  fmt.Sprintf(service, `,"labels":{"svc":"api"}`),
+			obj:  fmt.Sprintf(service, `,"labels":{"svc":"web"}`),
+			want: true,
+		},
+		{
+			name: "service svc label unchanged",
+			kind: serviceKind,
+			rule: ruleSvcSvcImmutable,
+			old:  fmt.Sprintf(service, `,"labels":{"svc":"api"}`),
+			obj:  fmt.Sprintf(service, `,"labels":{"svc":"api"}`),
+		},
+		{
+			name: "ingress host changed",
+			kind: ingressKind,
+			rule: ruleIngHostImmutable,
+			old:  fmt.Sprintf(ingress, "a.example.com"),
+			obj:  fmt.Sprintf(ingress, "b.example.com"),
+			want: true,
+		},
+		{
+			name: "ingress host unchanged",
+			kind: ingressKind,
+			rule: ruleIngHostImmutable,
+			old:  fmt.Sprintf(ingress, "a.example.com"),
+			obj:  fmt.Sprintf(ingress, "a.example.com"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := handlerFor(tt.kind, "")
+			if h == nil {
+				t.Fatalf("no handler for %v", tt.kind)
+			}
+			req := &admissionRequest{
+				UID:       "test",
+				Kind:      tt.kind,
+				Resource:  h.resource,
+				Name:      "api",
+				Namespace: "tools-dev",
+				Operation: tt.operation,
+			}
+			if req.Operation == "" {
+				req.Operation = operationUpdate
+			}
+			req.Object.Raw = []byte(tt.obj)
+			req.OldObject.Raw = []byte(tt.old)
+			req.log = requestLogger(admitPath, req)
+
+			_, err := admitByKind(cfg, req)
+			got := false
+			if verr, ok := err.(*violationError); ok {
+				for _, v := range verr.violations {
+					got = got || v.Rule == tt.rule
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v violated %v, want %v: %v", tt.rule, got, tt.want, err)
+			}
+		})
+	}
+}
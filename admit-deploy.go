@@ -1,15 +1,10 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"log"
 	"strings"
 
-	"k8s.io/api/admission/v1beta1"
-	appsv1 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -17,195 +12,309 @@ var (
 	deployAppsResource = metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
 )
 
-// admitDeploy
-func admitDeploy(req *v1beta1.AdmissionRequest) ([]patchOperation, error) {
-	var msg string
-	// This handler should only get called on ingress objects as per the MutatingWebhookConfiguration in the YAML file.
-	// However, if (for whatever reason) this gets invoked on an object of a different kind, issue a log message but
-	// let the object request pass through otherwise.
-	msg = fmt.Sprintf("admitDeploy evoked! Namespace: %v Name: %v Group: %v Version: %v Resource: %v Operation: %v\n", req.Namespace, req.Name, req.Resource.Group, req.Resource.Version, req.Resource.Resource, req.Operation)
-	log.Print(msg)
+// workload rules and mutations apply to every kind in workloadKinds. The rule IDs keep the DEPLOY prefix they had when
+// only Deployments were admitted, so that existing rule config keeps working.
+func init() {
+	for _, k := range workloadKinds {
+		registerHandlers(&admitHandler{
+			kind:     k.kind,
+			resource: k.resource,
+			admit:    admitWorkload,
+			rules:    "workload",
+			decode:   decodeWorkloadInput,
+			sample:   workloadSample(k),
+			alias:    k.alias,
+		})
+	}
+	registerRules(
+		&rule{
+			ID:          ruleDeployDescription,
+			Resource:    "workload",
+			Description: "metadata.annotations.description must be set, and spec.jobTemplate.metadata.annotations.description of a CronJob",
+			check: func(in *ruleInput, v *violations) {
+				// reject if annotations section or description is missing
+				if in.Workload.meta.Annotations == nil {
+					v.missing("metadata.annotations", "metadata.annotations object is missing")
+				} else if _, ok := in.Workload.meta.Annotations["description"]; !ok {
+					v.missing("metadata.annotations.description", "metadata.annotations.description is missing")
+				}
+				// the Jobs of a CronJob only get the annotations of its job template, and are held to this rule too
+				if in.Workload.jobMeta != nil {
+					if _, ok := in.Workload.jobMeta.Annotations["description"]; !ok {
+						v.missing("spec.jobTemplate.metadata.annotations.description", "spec.jobTemplate.metadata.annotations.description is missing")
+					}
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeploySvcLabel,
+			Resource:    "workload",
+			Description: "metadata.labels.svc must be set, and spec.jobTemplate.metadata.labels.svc of a CronJob",
+			check: func(in *ruleInput, v *violations) {
+				if _, ok := in.Workload.meta.Labels["svc"]; !ok {
+					v.missing("metadata.labels.svc", "metadata.labels.svc is missing")
+				}
+				// the Jobs of a CronJob only get the labels of its job template, and are held to this rule too
+				if in.Workload.jobMeta != nil {
+					if _, ok := in.Workload.jobMeta.Labels["svc"]; !ok {
+						v.missing("spec.jobTemplate.metadata.labels.svc", "spec.jobTemplate.metadata.labels.svc is missing")
+					}
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeploySvcLabelMatch,
+			Resource:    "workload",
+			Description: "metadata.labels.svc must be equal to the workload name, or the name of the Deployment or CronJob that generated the name of a ReplicaSet or Job, and spec.jobTemplate.metadata.labels.svc of a CronJob to metadata.labels.svc",
+			check: func(in *ruleInput, v *violations) {
+				svcLabelValue, ok := in.Workload.meta.Labels["svc"]
+				if !ok {
+					return
+				}
+				// so that the Jobs of the CronJob match the CronJob's name
+				if in.Workload.jobMeta != nil {
+					if jobSvcLabelValue, ok := in.Workload.jobMeta.Labels["svc"]; ok && jobSvcLabelValue != svcLabelValue {
+						v.invalid("spec.jobTemplate.metadata.labels.svc", "spec.jobTemplate.metadata.labels.svc: %v must be equal to metadata.labels.svc: %v", jobSvcLabelValue, svcLabelValue)
+					}
+				}
+				// ReplicaSets and Jobs created by a controller are named after their owner with a generated suffix
+				if owner := in.Workload.generatedOwner(); owner != nil {
+					if svcLabelValue != owner.Name {
+						v.invalid("metadata.labels.svc", "metadata.labels.svc: %v must be equal to %v name %v", svcLabelValue, strings.ToLower(owner.Kind), owner.Name)
+					}
+					return
+				}
+				if svcLabelValue != in.Workload.meta.Name {
+					v.invalid("metadata.labels.svc", "metadata.labels.svc: %v must be equal to %v name", svcLabelValue, strings.ToLower(in.Workload.kind))
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeployTemplateLabel,
+			Resource:    "workload",
+			Description: "the pod template's metadata.labels.svc must be set and equal to metadata.labels.svc",
+			check: func(in *ruleInput, v *violations) {
+				svcLabelValue, hasSvcLabel := in.Workload.meta.Labels["svc"]
+				templateSvcLabelValue, ok := in.Workload.template.ObjectMeta.Labels["svc"]
+				field := in.Workload.field("metadata", "labels", "svc")
+				if !ok {
+					v.missing(field, "%v is missing", field)
+				} else if hasSvcLabel && svcLabelValue != templateSvcLabelValue {
+					v.invalid(field, "%v: %v must be equal to metadata.lables.svc: %v", field, templateSvcLabelValue, svcLabelValue)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeploySelectorLabel,
+			Resource:    "workload",
+			Description: "spec.selector.matchLabels.svc must be set and equal to metadata.labels.svc, Jobs and CronJobs are not checked as their selector is generated",
+			check: func(in *ruleInput, v *violations) {
+				if !in.Workload.hasSelector {
+					return
+				}
+				svcLabelValue, hasSvcLabel := in.Workload.meta.Labels["svc"]
+				var matchLabels map[string]string
+				if in.Workload.selector != nil {
+					matchLabels = in.Workload.selector.MatchLabels
+				}
+				matchSvcLabelValue, ok := matchLabels["svc"]
+				if !ok {
+					v.missing("spec.selector.matchLabels.svc", "spec.selector.matchlabels.svc is missing")
+				} else if hasSvcLabel && svcLabelValue != matchSvcLabelValue {
+					v.invalid("spec.selector.matchLabels.svc", "spec.selector.matchlabels.svc: %v must be equal to metadata.lables.svc: %v", matchSvcLabelValue, svcLabelValue)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeployImageTag,
+			Resource:    "workload",
+			Description: "container images must use a specific version tag, not latest or stable",
+			check: func(in *ruleInput, v *violations) {
+				for i, container := range in.Workload.template.Spec.Containers {
+					imageName := strings.ToLower(container.Image)
+					if strings.Contains(imageName, "latest") || strings.Contains(imageName, "stable") {
+						v.invalid(in.Workload.field("spec", fmt.Sprintf("containers[%d]", i), "image"), "container image tag: %v must not contain latest or stable, use specific version tag", imageName)
+					}
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeployRunAsNonRoot,
+			Resource:    "workload",
+			Description: "runAsNonRoot must not be combined with runAsUser 0",
+			check: func(in *ruleInput, v *violations) {
+				// Make sure that the settings are not contradictory, and fail the object creation if they are.
+				sc := in.Workload.template.Spec.SecurityContext
+				if sc != nil && sc.RunAsNonRoot != nil && *sc.RunAsNonRoot && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+					v.invalid(in.Workload.field("spec", "securityContext", "runAsUser"), "runAsNonRoot specified, but runAsUser set to 0 (the root user)")
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeployResources,
+			Resource:    "workload",
+			Description: "container requests and limits must meet the resource policy of the namespace",
+			check: func(in *ruleInput, v *violations) {
+				rp := in.Config.resourcePolicy(in.Namespace)
+				for i, container := range in.Workload.template.Spec.Containers {
+					_, problems := rp.resolve(container.Resources)
+					for _, p := range problems {
+						field := in.Workload.field("spec", fmt.Sprintf("containers[%d]", i), p.field)
+						if p.missing {
+							v.missing(field, "container %v: %v", container.Name, p.message)
+						} else {
+							v.invalid(field, "container %v: %v", container.Name, p.message)
+						}
+					}
+				}
+			},
+		},
+		&rule{
+			ID:          ruleDeploySvcImmutable,
+			Resource:    "workload",
+			Description: "metadata.labels.svc cannot be changed or removed once set",
+			check: func(in *ruleInput, v *violations) {
+				if in.Old != nil {
+					checkLabelUnchanged(in.Old.Workload.meta.Labels, in.Workload.meta.Labels, "svc", v)
+				}
+			},
+		},
+	)
+}
+
+// admitWorkload validates workloads against the registered workload rules and mutates their pod template for
+// windstream standards: container requests and limits as the resource policy of the namespace says, the TZ environment
+// variable and the pod security context. ReplicaSets and Jobs created by a controller are validated but not mutated.
+func admitWorkload(cfg *Config, req *admissionRequest) ([]patchOperation, error) {
+	req.log.WithField("resource", req.Resource.String()).Debug("admitWorkload evoked")
 	raw := req.Object.Raw
-	logReq(raw)
+	logReq(cfg, req)
 
-	// approve any deployment that is in an exempt Namespace
-	if !namespaceIsMonitored(req.Namespace) {
-		log.Printf("Approved deployment name: %v namespace: %v. Namespace is exempt from webhook validation\n", req.Name, req.Namespace)
+	// approve any workload that is in an exempt Namespace
+	if !cfg.namespaceIsMonitored(req.Namespace) {
+		req.log.Info("Approved, namespace is exempt from webhook validation")
 		return nil, nil
 	}
 
-	// approve any ingress that is specifically exempt
-	if deployIsExempt(req.Namespace, req.Name) {
-		log.Printf("Approved deployment name: %v namespace: %v. deployment is exempt from webhook validation\n", req.Name, req.Namespace)
+	// approve any deployment that is specifically exempt, exemptDeployments only names deployments
+	if req.Kind.Kind == "Deployment" && cfg.deployIsExempt(req.Namespace, req.Name) {
+		req.log.Info("Approved, deployment is exempt from webhook validation")
 		return nil, nil
 	}
 
-	// Parse the deployment object.
-	deploy := appsv1.Deployment{}
-	if _, _, err := universalDeserializer.Decode(raw, nil, &deploy); err != nil {
-		return nil, fmt.Errorf("could not deserialize deployment object: %v, deployment is being rejected", err)
-	}
-
-	// Retrieve the name and namespace
-	deployMetaData := deploy.ObjectMeta
-	deployName := deployMetaData.Name
-	deployNamespace := deployMetaData.Namespace
-
-	log.Printf("Validating deployment name: %v namespace: %v\n", deployName, deployNamespace)
-
-	// reject if annotations section is missing
-	if deployMetaData.Annotations == nil {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. metadata.annotations object is missing\n", deployName, deployNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
+	// Parse the workload object.
+	w, err := decodeWorkload(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%v, %v is being rejected", err, strings.ToLower(req.Kind.Kind))
 	}
 
-	// reject if description is missing
-	_, ok := deployMetaData.Annotations["description"]
-	if !ok {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. metadata.annotations.description is missing\n", deployName, deployNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
+	// the ReplicaSets of an exempt deployment are exempt with it
+	if owner := w.generatedOwner(); owner != nil && owner.Kind == "Deployment" && cfg.deployIsExempt(req.Namespace, owner.Name) {
+		req.log.WithField("deployment", owner.Name).Info("Approved, deployment of the replicaset is exempt from webhook validation")
+		return nil, nil
 	}
 
-	// reject if svc label is not present
-	svcLabelValue, ok := deployMetaData.Labels["svc"]
-	if !ok {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. metadata.labels.svc is missing\n", deployName, deployNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
+	in := &ruleInput{Config: cfg, Namespace: req.Namespace, Workload: w}
+	if req.Operation == operationUpdate && len(req.OldObject.Raw) > 0 {
+		old, err := decodeWorkload(req.OldObject.Raw)
+		if err != nil {
+			return nil, fmt.Errorf("could not deserialize old object: %v, %v is being rejected", err, strings.ToLower(req.Kind.Kind))
+		}
+		in.Old = &ruleInput{Config: cfg, Namespace: req.Namespace, Workload: old}
 	}
 
-	// reject if deployment name not equal to svc label
-	if deployName != svcLabelValue {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. metadata.labels.svc: %v must be equal to deployment name\n", deployName, deployNamespace, svcLabelValue)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
+	req.log.Debug("Validating workload")
 
-	// reject if template svc label is not present
-	templateSvcLabelValue, ok := deploy.Spec.Template.ObjectMeta.Labels["svc"]
-	if !ok {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. spec.template.metadata.labels.svc is missing\n", deployName, deployNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
+	// collect every violation so the workload is rejected once with the complete list
+	v := newViolations(strings.ToLower(w.kind), w.meta.Name, w.meta.Namespace)
+	evaluateRules("workload", in, v)
 
-	// reject if template svc label not equal to metadata svc label
-	if svcLabelValue != templateSvcLabelValue {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. spec.template.metadata.labels.svc: %v must be equal to metadata.lables.svc: %v\n", deployName, deployNamespace, templateSvcLabelValue, svcLabelValue)
-		log.Print(msg)
-		return nil, errors.New(msg)
+	// the pod template of a ReplicaSet or Job created by a controller is the owner's, which was patched when the owner
+	// was admitted. Patching the copy would make it differ from the owner's template, a Deployment would then no longer
+	// find its ReplicaSet by the template hash and keep creating new ones.
+	if owner := w.generatedOwner(); owner != nil {
+		req.log.WithField(strings.ToLower(owner.Kind), owner.Name).Debug("Not patching workload created by its owner")
+		return nil, v.err()
 	}
 
-	// reject if matchlabels svc label is not present
-	matchSvcLabelValue, ok := deploy.Spec.Selector.MatchLabels["svc"]
-	if !ok {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. spec.selector.matchlabels.svc is missing\n", deployName, deployNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
+	// build the patch against the workload as we may need to mutate it
+	patch, err := newPatchBuilder(raw)
+	if err != nil {
+		return nil, err
 	}
-
-	// reject if template svc label not equal to metadata svc label
-	if svcLabelValue != matchSvcLabelValue {
-		msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. spec.selector.matchlabels.svc: %v must be equal to metadata.lables.svc: %v\n", deployName, deployNamespace, matchSvcLabelValue, svcLabelValue)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
-
-	// declare patchOperation array as we may need to mutate this deployment
-	var patches []patchOperation
-	// get the array of containers for this deployment
-	deployContainers := deploy.Spec.Template.Spec.Containers
-
-	// create a container array to hold the mutated containers
-	var newContainers []v1.Container
-
-	// loop over the containers and mutate the resources limits and request
-	for _, container := range deployContainers {
-		// reject deployment if image name uses latest or stable tags
-		imageName := strings.ToLower(container.Image)
-		if strings.Contains(imageName, "latest") || strings.Contains(imageName, "stable") {
-			msg = fmt.Sprintf("Rejected deployment name: %v namespace: %v. container image tag: %v must not contain latest or stable, use specific version tag\n", deployName, deployNamespace, imageName)
-			log.Print(msg)
-			return nil, errors.New(msg)
+	// loop over the containers and patch only the fields that differ, a compliant container is not patched at all
+	rp := cfg.resourcePolicy(req.Namespace)
+	for i := range w.template.Spec.Containers {
+		container := &w.template.Spec.Containers[i]
+		// default or clamp the requests and limits of this container as the resource policy of the namespace says
+		if err := updtResources(patch, w, i, container, rp); err != nil {
+			return nil, err
 		}
-		// mutate requests.cpu and requests.memory for this container
-		updtResources(&container)
 		// mutate env, add TZ="UTC" environment variable if not already set
-		updtEnv(&container)
-		// append the mutated container to the newContainers array
-		newContainers = append(newContainers, container)
+		if err := updtEnv(patch, w, i, container); err != nil {
+			return nil, err
+		}
 	}
 
-	patches = append(patches, patchOperation{
-		Op:   "replace",
-		Path: "/spec/template/spec/containers",
-		// replace the current container array with the mutated container array
-		Value: newContainers,
-	})
-
 	// Retrieve the `runAsNonRoot` and `runAsUser` values.
 	var runAsNonRoot *bool
 	var runAsUser *int64
-	if deploy.Spec.Template.Spec.SecurityContext != nil {
-		runAsNonRoot = deploy.Spec.Template.Spec.SecurityContext.RunAsNonRoot
-		runAsUser = deploy.Spec.Template.Spec.SecurityContext.RunAsUser
+	if w.template.Spec.SecurityContext != nil {
+		runAsNonRoot = w.template.Spec.SecurityContext.RunAsNonRoot
+		runAsUser = w.template.Spec.SecurityContext.RunAsUser
 	}
 
 	if runAsNonRoot == nil {
-		patches = append(patches, patchOperation{
-			Op:   "add",
-			Path: "/spec/template/spec/securityContext/runAsNonRoot",
-			// The value must not be true if runAsUser is set to 0, as otherwise we would create a conflicting
-			// configuration ourselves.
-			Value: runAsUser == nil || *runAsUser != 0,
-		})
+		// The value must not be true if runAsUser is set to 0, as otherwise we would create a conflicting
+		// configuration ourselves.
+		if err := patch.set(runAsUser == nil || *runAsUser != 0, w.path("spec", "securityContext", "runAsNonRoot")...); err != nil {
+			return nil, err
+		}
 
 		if runAsUser == nil {
-			patches = append(patches, patchOperation{
-				Op:    "add",
-				Path:  "/spec/template/spec/securityContext/runAsUser",
-				Value: 65534,
-			})
+			if err := patch.set(65534, w.path("spec", "securityContext", "runAsUser")...); err != nil {
+				return nil, err
+			}
 		}
-	} else if *runAsNonRoot == true && (runAsUser != nil && *runAsUser == 0) {
-		// Make sure that the settings are not contradictory, and fail the object creation if they are.
-		return nil, errors.New("runAsNonRoot specified, but runAsUser set to 0 (the root user)")
 	}
 
-	log.Println("===== Begin Deployment Patch =====")
-	for _, patch := range patches {
-		log.Println(patch)
-	}
-	log.Println("===== End Deployment Patch =====")
+	patches := patch.operations()
+	logPatches(cfg, req, patches)
 
-	return patches, nil
+	// violations are returned with the patches, the object is only denied if one of the rules is enforced
+	return patches, v.err()
 }
 
-func updtResources(c *v1.Container) {
-	res := make(v1.ResourceList)
-	res["cpu"] = resource.MustParse("1m")
-	res["memory"] = resource.MustParse("8Mi")
-	c.Resources.Requests = res
-	return
+// updtResources patches the requests and limits of the i-th container that the resource policy sets or changes,
+// requests and limits the policy leaves alone are not patched. Problems the policy cannot fix are reported by
+// DEPLOY-RESOURCES.
+func updtResources(patch *patchBuilder, w *workload, i int, c *v1.Container, rp *resourcePolicy) error {
+	want, _ := rp.resolve(c.Resources)
+	for _, list := range []struct {
+		field     string
+		have, set v1.ResourceList
+	}{{"requests", c.Resources.Requests, want.Requests}, {"limits", c.Resources.Limits, want.Limits}} {
+		for _, name := range sortedResourceNames(list.set) {
+			q := list.set[name]
+			if have, ok := list.have[name]; ok && have.Cmp(q) == 0 {
+				continue
+			}
+			if err := patch.set(q.String(), w.containerPath(i, "resources", list.field, string(name))...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func updtEnv(c *v1.Container) {
-	// assume time zone env variable is not found
-	var tzFound bool = false
-	// create env variable structure to append to container env array if it is missing
-	tzenv := v1.EnvVar{Name: "TZ", Value: "UTC"}
+// updtEnv appends TZ="UTC" to the environment variables of the i-th container if it has no TZ variable.
+func updtEnv(patch *patchBuilder, w *workload, i int, c *v1.Container) error {
 	// loop over all env variables looking for TZ variable
 	for _, env := range c.Env {
 		if env.Name == "TZ" {
-			// indicate that we found a time zone env variable
-			tzFound = true
+			return nil
 		}
 	}
-	// if we did not find a time zone env variable then append TZ="UTC" to the container environment variables
-	if !tzFound {
-		c.Env = append(c.Env, tzenv)
-	}
-	return
+	// the env array is added if the container has none
+	return patch.set(v1.EnvVar{Name: "TZ", Value: "UTC"}, w.containerPath(i, "env", "-")...)
 }
@@ -1,131 +1,392 @@
 package main
 
 import (
-	"log"
+	"fmt"
 	"regexp"
+	"sort"
 	"strings"
 
+	networkv1beta1 "k8s.io/api/networking/v1beta1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
-func serviceIsExempt(ns string, name string) bool {
-	for _, exemptService := range config.ExemptServices {
-		if ns+"/"+name == exemptService {
-			return true
+// ingress rules are shared by the extensions/v1beta1 and networking.k8s.io/v1beta1 handlers. Both versions of the
+// Ingress have the same schema, so the object is always decoded into the networking type.
+// The rules implemented are
+// 1) reject ingresses with unapproved nginx annotations
+// 2) require certain nginx annotations
+// 3) reject ingresses with rules hostnames that do not match configured master ingresses
+// 4) require certain labels, add svc label if missing or mutate it if its invalid
+// 5) reject ingresses if the annotation values are malformed
+// 6) reject ingresses with more than one rules host
+// 7) reject ingresses (and possibly mutate) with rules paths that do not conform to standards
+// 8) reject ingresses where the ingress name does not match the rules backend service name
+// 9) reject ingresses where the svc label does not match the rules backend service name or add it if not supplied
+// 10) reject updates that change the rules host
+func init() {
+	registerRules(
+		&rule{
+			ID:          ruleIngSingleRule,
+			Resource:    "ingress",
+			Description: "spec.rules must have exactly one entry",
+			check: func(in *ruleInput, v *violations) {
+				if in.Ingress.Spec.Rules == nil {
+					v.missing("spec.rules", "Rules object is missing")
+				} else if len(in.Ingress.Spec.Rules) != 1 {
+					v.invalid("spec.rules", "Rules array has more than one entry specified")
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngHost,
+			Resource:    "ingress",
+			Description: "spec.rules.host must be one of the configured valid hosts",
+			check: func(in *ruleInput, v *violations) {
+				if r := ingressSingleRule(in.Ingress); r != nil && !in.Config.hostIsValid(r.Host) {
+					v.invalid("spec.rules[0].host", "spec.rules.host: %v is not a known hostname.", r.Host)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngHostImmutable,
+			Resource:    "ingress",
+			Description: "spec.rules.host cannot be changed once set",
+			check: func(in *ruleInput, v *violations) {
+				if in.Old == nil {
+					return
+				}
+				// an old ingress without exactly one rule has no host to keep, the new one is checked by ING-SINGLE-RULE
+				old, r := ingressSingleRule(in.Old.Ingress), ingressSingleRule(in.Ingress)
+				if old != nil && old.Host != "" && r != nil && r.Host != old.Host {
+					v.invalid("spec.rules[0].host", "spec.rules.host: %v cannot be changed to %v, create a new ingress instead", old.Host, r.Host)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMergeableType,
+			Resource:    "ingress",
+			Description: "nginx.org/mergeable-ingress-type annotation must be master or minion",
+			check: func(in *ruleInput, v *violations) {
+				annotations := in.Ingress.Annotations
+				if annotations == nil {
+					v.missing("metadata.annotations", "metadata.annotations object is missing")
+				} else if t, ok := annotations["nginx.org/mergeable-ingress-type"]; !ok {
+					v.missing("metadata.annotations.nginx.org/mergeable-ingress-type", "metadata.annotations nginx.org/mergeable-ingress-type is missing")
+				} else if !(t == "master" || t == "minion") {
+					v.invalid("metadata.annotations.nginx.org/mergeable-ingress-type", "metadata.annotations nginx.org/mergeable-ingress-type: %v is invalid", t)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngNginxAnnotations,
+			Resource:    "ingress",
+			Description: "nginx annotations must be allowed for the ingress type and match the configured regex",
+			check: func(in *ruleInput, v *violations) {
+				ingType := ingressType(in.Ingress)
+				if ingType == "" {
+					return
+				}
+				for _, k := range in.Config.checkAllowedNginxAnnotations(&in.Ingress.ObjectMeta, ingType) {
+					v.invalid("metadata.annotations."+k, "metadata.annotation.%v: %v is invalid or not allowed", k, in.Config.redactAnnotation(k, in.Ingress.Annotations[k]))
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMinionSinglePath,
+			Resource:    "ingress",
+			Description: "minion spec.rules.http.paths must have exactly one entry",
+			check: func(in *ruleInput, v *violations) {
+				r := ingressSingleRule(in.Ingress)
+				if ingressType(in.Ingress) != "minion" || r == nil {
+					return
+				}
+				if r.HTTP == nil {
+					v.missing("spec.rules[0].http", "spec.rules.http object is missing")
+				} else if r.HTTP.Paths == nil {
+					v.missing("spec.rules[0].http.paths", "spec.rules.http.paths object is missing")
+				} else if len(r.HTTP.Paths) != 1 {
+					v.invalid("spec.rules[0].http.paths", "spec.rules.http.paths array has more than one entry specified")
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMinionPathFormat,
+			Resource:    "ingress",
+			Description: "minion path must be /<namespace>/<backend serviceName>/",
+			check: func(in *ruleInput, v *violations) {
+				path, serviceName, ok := minionBackend(in.Ingress)
+				if !ok {
+					return
+				}
+				expectedPath := "/" + in.Ingress.Namespace + "/" + serviceName + "/"
+				if path != expectedPath {
+					v.invalid("spec.rules[0].http.paths[0].path", "spec.rules.http.paths.path is %v but expected %v", path, expectedPath)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMinionAnnotations,
+			Resource:    "ingress",
+			Description: "minions must have the configured required annotations with matching values, except nginx.org/ssl-services which ING-MINION-SSL-SERVICES checks",
+			check: func(in *ruleInput, v *violations) {
+				if ingressType(in.Ingress) != "minion" {
+					return
+				}
+				for _, k := range in.Config.checkMinionRequiredNginxAnnotations(&in.Ingress.ObjectMeta) {
+					// the annotation has its own rule, it is reported there only
+					if k == "nginx.org/ssl-services" {
+						continue
+					}
+					v.invalid("metadata.annotations."+k, "metadata.annotation.%v: %v is missing or invalid", k, in.Config.redactAnnotation(k, in.Ingress.Annotations[k]))
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMinionSslServices,
+			Resource:    "ingress",
+			Description: "minion nginx.org/ssl-services annotation must match the backend serviceName",
+			check: func(in *ruleInput, v *violations) {
+				if ingressType(in.Ingress) != "minion" {
+					return
+				}
+				sslSvc, ok := in.Ingress.Annotations["nginx.org/ssl-services"]
+				if !ok {
+					v.missing("metadata.annotations.nginx.org/ssl-services", "metadata.annotations nginx.org/ssl-services is missing")
+					return
+				}
+				if _, serviceName, ok := minionBackend(in.Ingress); ok && sslSvc != serviceName {
+					v.invalid("metadata.annotations.nginx.org/ssl-services", "metadata.annotations nginx.org/ssl-services: %v does not match backend.serviceName: %v", sslSvc, serviceName)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMinionLabels,
+			Resource:    "ingress",
+			Description: "minions must have the configured required labels with matching values",
+			check: func(in *ruleInput, v *violations) {
+				if ingressType(in.Ingress) != "minion" {
+					return
+				}
+				for _, k := range in.Config.checkMinionRequiredLabels(&in.Ingress.ObjectMeta) {
+					v.invalid("metadata.labels."+k, "metadata.labels.%v: %v is missing or invalid", k, in.Config.redactLabel(k, in.Ingress.Labels[k]))
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMinionSvcLabel,
+			Resource:    "ingress",
+			Description: "minion metadata.labels.svc must match the backend serviceName, it is added if missing",
+			check: func(in *ruleInput, v *violations) {
+				_, serviceName, ok := minionBackend(in.Ingress)
+				if !ok {
+					return
+				}
+				if svcLabelValue, ok := in.Ingress.Labels["svc"]; ok && svcLabelValue != serviceName {
+					v.invalid("metadata.labels.svc", "metadata.labels.svc: %v is invalid, it must match backend serviceName: %v", svcLabelValue, serviceName)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleIngMinionName,
+			Resource:    "ingress",
+			Description: "minion name must be the backend serviceName, or serviceName-inetsvcs on an inetsvcs host",
+			check: func(in *ruleInput, v *violations) {
+				_, serviceName, ok := minionBackend(in.Ingress)
+				if !ok {
+					return
+				}
+				// enforce ingress name equal to serviceName or serviceName + "-inetsvcs"
+				ingName := in.Ingress.Name
+				host := in.Ingress.Spec.Rules[0].Host
+				if serviceName == ingName || serviceName+"-inetsvcs" == ingName {
+					if serviceName+"-inetsvcs" == ingName && !strings.Contains(host, "inetsvcs") {
+						v.invalid("metadata.name", "Ingress name can only contain inetsvcs if hostname contains inetsvcs, host:  %v", host)
+					}
+				} else {
+					v.invalid("metadata.name", "Ingress name must be either %v or %v-inetsvcs", serviceName, serviceName)
+				}
+			},
+		},
+	)
+}
+
+// admitIngress validates networking.k8s.io/v1beta1 and extensions/v1beta1 ingresses against the registered ingress
+// rules and adds the svc label to minions that do not have one.
+func admitIngress(cfg *Config, req *admissionRequest) ([]patchOperation, error) {
+	req.log.WithField("resource", req.Resource.String()).Debug("admitIngress evoked")
+	raw := req.Object.Raw
+	logReq(cfg, req)
+
+	// approve any ingress that is in an exempt Namespace
+	if !cfg.namespaceIsMonitored(req.Namespace) {
+		req.log.Info("Approved, namespace is exempt from webhook validation")
+		return nil, nil
+	}
+
+	// approve any ingress that is specifically exempt
+	if cfg.ingressIsExempt(req.Namespace, req.Name) {
+		req.log.Info("Approved, ingress is exempt from webhook validation")
+		return nil, nil
+	}
+
+	// Parse the Ingress object.
+	ingress := networkv1beta1.Ingress{}
+	if _, _, err := universalDeserializer.Decode(raw, nil, &ingress); err != nil {
+		return nil, fmt.Errorf("could not deserialize ingress object: %v, ingress is being rejected", err)
+	}
+
+	in := &ruleInput{Config: cfg, Namespace: req.Namespace, Ingress: &ingress}
+	old := networkv1beta1.Ingress{}
+	if ok, err := decodeOldObject(req, &old); err != nil {
+		return nil, fmt.Errorf("could not deserialize old ingress object: %v, ingress is being rejected", err)
+	} else if ok {
+		in.Old = &ruleInput{Config: cfg, Namespace: req.Namespace, Ingress: &old}
+	}
+
+	req.log.Debug("Validating ingress")
+
+	// collect every violation so the ingress is rejected once with the complete list
+	v := newViolations("ingress", ingress.Name, ingress.Namespace)
+	evaluateRules("ingress", in, v)
+
+	// build the patch against the ingress as we may want to mutate it
+	patch, err := newPatchBuilder(raw)
+	if err != nil {
+		return nil, err
+	}
+	// try to get svc label of a minion, if its missing add it
+	if _, serviceName, ok := minionBackend(&ingress); ok {
+		if _, ok := ingress.Labels["svc"]; !ok {
+			// svc label is missing, lets patch it into the ingress resource, the labels map is added if there is none
+			req.log.Infof("Ingress is missing svc label, adding svc: %v to ingress", serviceName)
+			if err := patch.set(serviceName, "metadata", "labels", "svc"); err != nil {
+				return nil, err
+			}
 		}
 	}
-	return false
+
+	// violations are returned with the patches, the object is only denied if one of the rules is enforced
+	return patch.operations(), v.err()
 }
 
-func deployIsExempt(ns string, name string) bool {
-	for _, exemptDeploy := range config.ExemptDeployments {
-		if ns+"/"+name == exemptDeploy {
-			return true
-		}
+// decodeIngressInput decodes an ingress of either version for the ingress rules.
+func decodeIngressInput(raw []byte) (*ruleInput, error) {
+	ingress := networkv1beta1.Ingress{}
+	if _, _, err := universalDeserializer.Decode(raw, nil, &ingress); err != nil {
+		return nil, fmt.Errorf("could not deserialize ingress object: %v", err)
 	}
-	return false
+	return &ruleInput{Ingress: &ingress}, nil
 }
 
-func ingressIsExempt(ns string, name string) bool {
-	for _, exemptIng := range config.ExemptIngresses {
-		if ns+"/"+name == exemptIng {
-			return true
-		}
+// ingressType returns the nginx.org/mergeable-ingress-type of the ingress, or "" if it is not master or minion.
+func ingressType(ing *networkv1beta1.Ingress) string {
+	t := ing.Annotations["nginx.org/mergeable-ingress-type"]
+	if t == "master" || t == "minion" {
+		return t
 	}
-	return false
+	return ""
 }
 
-func hostIsValid(host string) bool {
-	for _, validHost := range config.ValidHosts {
-		if host == validHost {
-			return true
-		}
+// ingressSingleRule returns the only entry of spec.rules, or nil if there is not exactly one.
+func ingressSingleRule(ing *networkv1beta1.Ingress) *networkv1beta1.IngressRule {
+	if len(ing.Spec.Rules) != 1 {
+		return nil
+	}
+	return &ing.Spec.Rules[0]
+}
+
+// minionBackend returns the path and backend serviceName of a minion ingress, ok is false if the ingress is not a
+// minion or does not have exactly one rule with exactly one http path.
+func minionBackend(ing *networkv1beta1.Ingress) (path string, serviceName string, ok bool) {
+	r := ingressSingleRule(ing)
+	if ingressType(ing) != "minion" || r == nil || r.HTTP == nil || len(r.HTTP.Paths) != 1 {
+		return "", "", false
 	}
-	return false
+	return r.HTTP.Paths[0].Path, r.HTTP.Paths[0].Backend.ServiceName, true
+}
+
+func (c *Config) serviceIsExempt(ns string, name string) bool {
+	return c.compiled().exemptServices[ns+"/"+name]
+}
+
+func (c *Config) deployIsExempt(ns string, name string) bool {
+	return c.compiled().exemptDeployments[ns+"/"+name]
+}
+
+func (c *Config) ingressIsExempt(ns string, name string) bool {
+	return c.compiled().exemptIngresses[ns+"/"+name]
+}
+
+func (c *Config) hostIsValid(host string) bool {
+	return c.compiled().validHosts[host]
 }
 
-func checkAllowedNginxAnnotations(i *metav1.ObjectMeta, ingType string) (string, string, bool) {
-	log.Print("CheckAllowedNginxAnnotations routine is running...")
-	var ok bool
-	var testRegEx string
+// checkAllowedNginxAnnotations returns the sorted keys of every nginx annotation that is not allowed for the given
+// ingress type or whose value does not match the configured regex.
+func (c *Config) checkAllowedNginxAnnotations(i *metav1.ObjectMeta, ingType string) []string {
+	allow := c.compiled().nginxMinionAllow
+	if ingType == "master" {
+		allow = c.compiled().nginxMasterAllow
+	}
+	var bad []string
 	for k, v := range i.Annotations {
 		if strings.HasPrefix(k, "nginx.org/") ||
 			strings.HasPrefix(k, "nginx.com/") ||
 			strings.HasPrefix(k, "custom.nginx.org/") {
-			if ingType == "master" {
-				testRegEx, ok = config.NginxMasterIngressAllow[k]
-			} else {
-				testRegEx, ok = config.NginxMinionIngressAllow[k]
-			}
-			// if we found an nginx annotation that is not allowed return it with ok = false
+			re, ok := allow[k]
+			// if we found an nginx annotation that is not allowed record it
 			if !ok {
-				log.Printf("ingress contains %v annotation, but its not in the nginx allowed list", k)
-				return k, v, ok
+				bad = append(bad, k)
+				continue
 			}
-			// compile the regex string from the app config
-			re, err := regexp.Compile(testRegEx)
-			// if the regex won't compile then log the error and skip testing this value
-			if err != nil {
-				log.Printf("Unable to validate %v ingress annotation: %v regex configuration %v is invalid err: %v\n", ingType, k, testRegEx, err.Error())
-			} else {
-				// test if annotation value matches configured regular expression
-				if !re.Match([]byte(v)) {
-					log.Printf("annotation name: %v value: %v did not match regex %v\n", k, v, testRegEx)
-					return k, v, false
-				}
+			// a regex that does not compile never loads, validateConfig rejects the config
+			if re == nil {
+				logger.WithField("rule", ruleIngNginxAnnotations).Errorf("unable to validate %v ingress annotation: %v regex configuration is invalid", ingType, k)
+				continue
 			}
-
-		}
-	}
-	return "", "", true
-}
-func checkMinionRequiredNginxAnnotations(i *metav1.ObjectMeta) (string, string, bool) {
-	log.Print("CheckMinionRequiredNginxAnnotations routine is running...")
-	var ok bool
-	var reqValue string
-	for k, v := range config.IngressMinionRequiredAnnotations {
-		reqValue, ok = i.Annotations[k]
-		// throw error if required annotation is not found
-		if !ok {
-			return k, "", false
-		}
-		// compile the regex string from the app config
-		re, err := regexp.Compile(v)
-		// if the regex won't compile then log the error and skip testing this value
-		if err != nil {
-			log.Printf("Unable to validate ingress annotation: %v regex configuration %v is invalid err: %v\n", k, v, err.Error())
-		} else {
 			// test if annotation value matches configured regular expression
-			if !re.Match([]byte(reqValue)) {
-				log.Printf("annotation name: %v value: %v did not match regex %v\n", k, reqValue, v)
-				return k, reqValue, false
+			if !re.MatchString(v) {
+				bad = append(bad, k)
 			}
 		}
 	}
-	return "", "", true
+	sort.Strings(bad)
+	return bad
 }
-func checkMinionRequiredLabels(i *metav1.ObjectMeta) (string, string, bool) {
-	log.Printf("chekcMinionRequiredLabels is running...")
-	var ok bool
-	var reqValue string
-	for k, v := range config.IngressMinionRequiredLabels {
-		reqValue, ok = i.Labels[k]
-		// throw error if required label is not found
+
+// checkMinionRequiredNginxAnnotations returns the sorted keys of every required minion annotation that is missing or
+// whose value does not match the configured regex.
+func (c *Config) checkMinionRequiredNginxAnnotations(i *metav1.ObjectMeta) []string {
+	return checkRequired(c.compiled().minionRequiredAnnotations, i.Annotations, ruleIngMinionAnnotations, "annotation")
+}
+
+// checkMinionRequiredLabels returns the sorted keys of every required minion label that is missing or whose value
+// does not match the configured regex.
+func (c *Config) checkMinionRequiredLabels(i *metav1.ObjectMeta) []string {
+	return checkRequired(c.compiled().minionRequiredLabels, i.Labels, ruleIngMinionLabels, "label")
+}
+
+// checkRequired returns the sorted keys of every required entry that is missing from values or whose value does not
+// match the required regex.
+func checkRequired(required map[string]*regexp.Regexp, values map[string]string, rule string, what string) []string {
+	var bad []string
+	for k, re := range required {
+		value, ok := values[k]
+		// record the required entry if it is not found
 		if !ok {
-			return k, "", false
+			bad = append(bad, k)
+			continue
 		}
-		// compile the regex string from the app config
-		re, err := regexp.Compile(v)
-		// if the regex won't compile then log the error and skip testing this value
-		if err != nil {
-			log.Printf("Unable to validate ingress label: %v regex configuration %v is invalid err: %v\n", k, v, err.Error())
-		} else {
-			// test if annotation value matches configured regular expression
-			if !re.Match([]byte(reqValue)) {
-				log.Printf("annotation name: %v value: %v did not match regex %v\n", k, reqValue, v)
-				return k, reqValue, false
-			}
+		// a regex that does not compile never loads, validateConfig rejects the config
+		if re == nil {
+			logger.WithField("rule", rule).Errorf("unable to validate ingress %v: %v regex configuration is invalid", what, k)
+			continue
+		}
+		// test if the value matches the configured regular expression
+		if !re.MatchString(value) {
+			bad = append(bad, k)
 		}
 	}
-	return "", "", true
+	sort.Strings(bad)
+	return bad
 }
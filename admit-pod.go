@@ -1,11 +1,8 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"log"
 
-	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -14,6 +11,31 @@ var (
 	podResource = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
 )
 
+func init() {
+	registerHandlers(&admitHandler{
+		kind:     metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		resource: podResource,
+		admit:    admitPod,
+		rules:    "pod",
+		decode:   decodePodInput,
+		sample: `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"admit-self-check"},
+			"spec":{"containers":[{"name":"app","image":"alpine:3.12"}]}}`,
+		alias: "/admit-pod",
+	})
+	registerRules(&rule{
+		ID:          rulePodRunAsNonRoot,
+		Resource:    "pod",
+		Description: "runAsNonRoot must not be combined with runAsUser 0",
+		check: func(in *ruleInput, v *violations) {
+			// Make sure that the settings are not contradictory, and fail the object creation if they are.
+			sc := in.Pod.Spec.SecurityContext
+			if sc != nil && sc.RunAsNonRoot != nil && *sc.RunAsNonRoot && sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+				v.invalid("spec.securityContext.runAsUser", "runAsNonRoot specified, but runAsUser set to 0 (the root user)")
+			}
+		},
+	})
+}
+
 // admitPod validates and mutates pods for windstream standards
 // the application configuration contains a list of exempt namespaces
 // additionally the controller will not process anything publicly known as a kubernetes namespace
@@ -28,20 +50,13 @@ var (
 //
 // Note that we combine both the setting of defaults and the check for potential conflicts in one webhook; ideally,
 // the latter would be performed in a validating webhook admission controller.
-func admitPod(req *v1beta1.AdmissionRequest) ([]patchOperation, error) {
+func admitPod(cfg *Config, req *admissionRequest) ([]patchOperation, error) {
 	raw := req.Object.Raw
-	logReq(raw)
-	// This handler should only get called on Pod objects as per the MutatingWebhookConfiguration in the YAML file.
-	// However, if (for whatever reason) this gets invoked on an object of a different kind, issue a log message but
-	// let the object request pass through otherwise.
-	if req.Resource != podResource {
-		log.Printf("expect resource to be %s", podResource)
-		return nil, nil
-	}
+	logReq(cfg, req)
 
 	// approve any pod that is in an un-monitored Namespace
-	if !namespaceIsMonitored(req.Namespace) {
-		log.Printf("Approved pod name: %v namespace: %v. Namespace is exempt from webhook validation\n", req.Name, req.Namespace)
+	if !cfg.namespaceIsMonitored(req.Namespace) {
+		req.log.Info("Approved, namespace is exempt from webhook validation")
 		return nil, nil
 	}
 
@@ -59,28 +74,36 @@ func admitPod(req *v1beta1.AdmissionRequest) ([]patchOperation, error) {
 		runAsUser = pod.Spec.SecurityContext.RunAsUser
 	}
 
+	v := newViolations("pod", pod.Name, pod.Namespace)
+	evaluateRules("pod", &ruleInput{Config: cfg, Namespace: req.Namespace, Pod: &pod}, v)
+
 	// Create patch operations to apply sensible defaults, if those options are not set explicitly.
-	var patches []patchOperation
+	patch, err := newPatchBuilder(raw)
+	if err != nil {
+		return nil, err
+	}
 	if runAsNonRoot == nil {
-		patches = append(patches, patchOperation{
-			Op:   "add",
-			Path: "/spec/securityContext/runAsNonRoot",
-			// The value must not be true if runAsUser is set to 0, as otherwise we would create a conflicting
-			// configuration ourselves.
-			Value: runAsUser == nil || *runAsUser != 0,
-		})
+		// The value must not be true if runAsUser is set to 0, as otherwise we would create a conflicting
+		// configuration ourselves.
+		if err := patch.set(runAsUser == nil || *runAsUser != 0, "spec", "securityContext", "runAsNonRoot"); err != nil {
+			return nil, err
+		}
 
 		if runAsUser == nil {
-			patches = append(patches, patchOperation{
-				Op:    "add",
-				Path:  "/spec/securityContext/runAsUser",
-				Value: 65534,
-			})
+			if err := patch.set(65534, "spec", "securityContext", "runAsUser"); err != nil {
+				return nil, err
+			}
 		}
-	} else if *runAsNonRoot == true && (runAsUser != nil && *runAsUser == 0) {
-		// Make sure that the settings are not contradictory, and fail the object creation if they are.
-		return nil, errors.New("runAsNonRoot specified, but runAsUser set to 0 (the root user)")
 	}
 
-	return patches, nil
+	return patch.operations(), v.err()
+}
+
+// decodePodInput decodes a pod for the pod rules.
+func decodePodInput(raw []byte) (*ruleInput, error) {
+	pod := corev1.Pod{}
+	if _, _, err := universalDeserializer.Decode(raw, nil, &pod); err != nil {
+		return nil, fmt.Errorf("could not deserialize pod object: %v", err)
+	}
+	return &ruleInput{Pod: &pod}, nil
 }
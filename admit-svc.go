@@ -1,11 +1,8 @@
 package main
 
 import (
-	"errors"
 	"fmt"
-	"log"
 
-	"k8s.io/api/admission/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
@@ -14,89 +11,118 @@ var (
 	svcResource = metav1.GroupVersionResource{Version: "v1", Resource: "services"}
 )
 
+func init() {
+	registerHandlers(&admitHandler{
+		kind:     metav1.GroupVersionKind{Version: "v1", Kind: "Service"},
+		resource: svcResource,
+		admit:    admitSvc,
+		rules:    "service",
+		decode:   decodeSvcInput,
+		sample: `{"apiVersion":"v1","kind":"Service","metadata":{"name":"admit-self-check","labels":{"svc":"admit-self-check"},"annotations":{"description":"readiness self-check"}},
+			"spec":{"selector":{"svc":"admit-self-check"},"ports":[{"port":80}]}}`,
+		alias: "/admit-svc",
+	})
+	registerRules(
+		&rule{
+			ID:          ruleSvcDescription,
+			Resource:    "service",
+			Description: "metadata.annotations.description must be set",
+			check: func(in *ruleInput, v *violations) {
+				// reject if annotations section or description annotation is missing
+				if in.Service.Annotations == nil {
+					v.missing("metadata.annotations", "metadata.annotations object is missing")
+				} else if _, ok := in.Service.Annotations["description"]; !ok {
+					v.missing("metadata.annotations.description", "metadata.annotations.description is missing")
+				}
+			},
+		},
+		&rule{
+			ID:          ruleSvcLabel,
+			Resource:    "service",
+			Description: "metadata.labels.svc must be set and equal to the service name",
+			check: func(in *ruleInput, v *violations) {
+				svcLabelValue, ok := in.Service.Labels["svc"]
+				if !ok {
+					v.missing("metadata.labels.svc", "metadata.labels.svc is missing")
+				} else if svcLabelValue != in.Service.Name {
+					v.invalid("metadata.labels.svc", "metadata.labels.svc: %v must match service Name: %v", svcLabelValue, in.Service.Name)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleSvcSelector,
+			Resource:    "service",
+			Description: "spec.selector.svc must be set and equal to the service name",
+			check: func(in *ruleInput, v *violations) {
+				selectorValue, ok := in.Service.Spec.Selector["svc"]
+				if !ok {
+					v.missing("spec.selector.svc", "spec.selector.svc is missing")
+				} else if selectorValue != in.Service.Name {
+					v.invalid("spec.selector.svc", "spec.selector.svc: %v must match service Name: %v", selectorValue, in.Service.Name)
+				}
+			},
+		},
+		&rule{
+			ID:          ruleSvcSvcImmutable,
+			Resource:    "service",
+			Description: "metadata.labels.svc cannot be changed or removed once set",
+			check: func(in *ruleInput, v *violations) {
+				if in.Old != nil {
+					checkLabelUnchanged(in.Old.Service.Labels, in.Service.Labels, "svc", v)
+				}
+			},
+		},
+	)
+}
+
 // admitSvc validates and mutates services for windstream standards
-func admitSvc(req *v1beta1.AdmissionRequest) ([]patchOperation, error) {
+func admitSvc(cfg *Config, req *admissionRequest) ([]patchOperation, error) {
 	var patches []patchOperation
-	var msg string
-	log.Printf("admitSvc evoked! Namespace: %v Name: %v Group: %v Version: %v Resource: %v Operation: %v\n", req.Namespace, req.Name, req.Resource.Group, req.Resource.Version, req.Resource.Resource, req.Operation)
+	req.log.WithField("resource", req.Resource.String()).Debug("admitSvc evoked")
 	raw := req.Object.Raw
-	logReq(raw)
+	logReq(cfg, req)
 
 	// approve any ingress that is in an un-monitored Namespace
-	if !namespaceIsMonitored(req.Namespace) {
-		log.Printf("Approved service name: %v namespace: %v. Namespace is exempt from webhook validation\n", req.Name, req.Namespace)
+	if !cfg.namespaceIsMonitored(req.Namespace) {
+		req.log.Info("Approved, namespace is exempt from webhook validation")
 		return nil, nil
 	}
 
-	// approve any ingress that is specifically exempt
-	if serviceIsExempt(req.Namespace, req.Name) {
-		log.Printf("Approved service name: %v namespace: %v. Service is exempt from webhook validation\n", req.Name, req.Namespace)
-		return nil, nil
-	}
-	// This handler should only get called on Pod objects as per the MutatingWebhookConfiguration in the YAML file.
-	// However, if (for whatever reason) this gets invoked on an object of a different kind, issue a log message but
-	// let the object request pass through otherwise.
-	if req.Resource != svcResource {
-		log.Printf("expect resource to be %s", svcResource)
+	// approve any service that is specifically exempt
+	if cfg.serviceIsExempt(req.Namespace, req.Name) {
+		req.log.Info("Approved, service is exempt from webhook validation")
 		return nil, nil
 	}
 
-	// Parse the Pod object.
+	// Parse the Service object.
 	svc := corev1.Service{}
 	if _, _, err := universalDeserializer.Decode(raw, nil, &svc); err != nil {
-		return nil, fmt.Errorf("could not deserialize pod object: %v", err)
+		return nil, fmt.Errorf("could not deserialize service object: %v", err)
 	}
 
-	// Retrieve the name and namespace
-	svcMetaData := svc.ObjectMeta
-	svcName := svcMetaData.Name
-	svcNamespace := svcMetaData.Namespace
-
-	log.Printf("Validating service name: %v namespace: %v\n", svcName, svcNamespace)
-
-	// reject if annotations section is missing
-	if svcMetaData.Annotations == nil {
-		msg = fmt.Sprintf("Rejected service name: %v namespace: %v. metadata.annotations object is missing\n", svcName, svcNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
+	in := &ruleInput{Config: cfg, Namespace: req.Namespace, Service: &svc}
+	old := corev1.Service{}
+	if ok, err := decodeOldObject(req, &old); err != nil {
+		return nil, fmt.Errorf("could not deserialize old service object: %v", err)
+	} else if ok {
+		in.Old = &ruleInput{Config: cfg, Namespace: req.Namespace, Service: &old}
 	}
 
-	// try to get svc label if its missing add it.  If its present validate it matches serviceName
-	svcLabelValue, ok := svcMetaData.Labels["svc"]
-	if !ok {
-		// svc label is missing
-		msg = fmt.Sprintf("Rejected service name: %v namespace: %v is missing svc label\n", svcName, svcNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
-	if svcLabelValue != svcName {
-		msg = fmt.Sprintf("Rejected service name: %v namespace: %v. metadata.labels.svc: %v must match service Name: %v\n", svcName, svcNamespace, svcLabelValue, svcName)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
+	req.log.Debug("Validating service")
 
-	// try to get description annotation
-	_, ok = svcMetaData.Annotations["description"]
-	if !ok {
-		// description annotation is missing
-		msg = fmt.Sprintf("Rejected service name: %v namespace: %v is missing description annotation\n", svcName, svcNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
+	// collect every violation so the service is rejected once with the complete list
+	v := newViolations("service", svc.Name, svc.Namespace)
+	evaluateRules("service", in, v)
 
-	// try to get selector
-	selectorValue, ok := svc.Spec.Selector["svc"]
-	if !ok {
-		// svc selector is missing
-		msg = fmt.Sprintf("Rejected service name: %v namespace: %v is missing selector svc\n", svcName, svcNamespace)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
-	if selectorValue != svcName {
-		msg = fmt.Sprintf("Rejected service name: %v namespace: %v. spec.selector.svc: %v must match service Name: %v\n", svcName, svcNamespace, selectorValue, svcName)
-		log.Print(msg)
-		return nil, errors.New(msg)
-	}
+	// violations are returned with the patches, the object is only denied if one of the rules is enforced
+	return patches, v.err()
+}
 
-	return patches, nil
+// decodeSvcInput decodes a service for the service rules.
+func decodeSvcInput(raw []byte) (*ruleInput, error) {
+	svc := corev1.Service{}
+	if _, _, err := universalDeserializer.Decode(raw, nil, &svc); err != nil {
+		return nil, fmt.Errorf("could not deserialize service object: %v", err)
+	}
+	return &ruleInput{Service: &svc}, nil
 }
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// audit sink types selectable with audit.sink
+const (
+	auditSinkFile = "file"
+	auditSinkHTTP = "http"
+)
+
+// audit defaults used when the config does not set them
+const (
+	defaultAuditBufferSize  = 1000
+	defaultAuditMaxSizeMB   = 100
+	defaultAuditMaxBackups  = 5
+	defaultAuditHTTPTimeout = 5 * time.Second
+)
+
+// AuditConfig selects where admission decisions are recorded. Sink is file, http or empty to switch the audit trail
+// off. The audit config is applied when the server starts, changing it requires a restart.
+type AuditConfig struct {
+	Sink string
+	// BufferSize is the number of records held while the sink is slow, records are dropped when it is full
+	BufferSize int
+	// IncludeDryRun records server-side dry runs too, marked with dryRun. They are not recorded by default, as
+	// nothing was admitted.
+	IncludeDryRun bool
+	File          FileAuditConfig
+	HTTP          HTTPAuditConfig
+}
+
+// FileAuditConfig configures the rotating JSONL file sink. The file is rotated when it would exceed MaxSizeMB, keeping
+// MaxBackups rotated files named Path.1 (newest) to Path.MaxBackups.
+type FileAuditConfig struct {
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+}
+
+// HTTPAuditConfig configures the HTTP sink, every record is POSTed to URL as a JSON document.
+type HTTPAuditConfig struct {
+	URL string
+	// Timeout is a duration string such as "5s"
+	Timeout string
+}
+
+// auditRecord is the persisted account of one admission decision.
+type auditRecord struct {
+	Timestamp  time.Time   `json:"timestamp"`
+	UID        types.UID   `json:"uid"`
+	User       string      `json:"user"`
+	Groups     []string    `json:"groups,omitempty"`
+	Endpoint   string      `json:"endpoint"`
+	Kind       string      `json:"kind"`
+	Namespace  string      `json:"namespace"`
+	Name       string      `json:"name"`
+	Operation  string      `json:"operation"`
+	DryRun     bool        `json:"dryRun,omitempty"`
+	Decision   string      `json:"decision"`
+	Allowed    bool        `json:"allowed"`
+	Violations []violation `json:"violations,omitempty"`
+	// Patch is the JSON patch returned to the apiserver, with sensitive values redacted
+	Patch         json.RawMessage `json:"patch,omitempty"`
+	ConfigVersion string          `json:"configVersion"`
+	Error         string          `json:"error,omitempty"`
+}
+
+// auditSink persists audit records. Write and Close are only ever called from one goroutine.
+type auditSink interface {
+	Write(record *auditRecord) error
+	Close() error
+}
+
+// auditor hands records to the sink through a buffered channel, so that a slow sink never delays an admission
+// response. Records that do not fit in the buffer are dropped and counted.
+type auditor struct {
+	sink          auditSink
+	includeDryRun bool
+	records       chan *auditRecord
+	// abort is closed when close times out, the records still queued are then dropped
+	abort chan struct{}
+	done  chan struct{}
+	// mu guards closed, records are only sent while it is read locked and closed is false
+	mu     sync.RWMutex
+	closed bool
+}
+
+// auditTrail is the auditor every decision is recorded with, it is nil when the audit trail is switched off.
+var auditTrail *auditor
+
+// newAuditor creates the sink selected by the config and starts writing to it, it returns nil if no sink is
+// configured.
+func newAuditor(c AuditConfig) (*auditor, error) {
+	var sink auditSink
+	switch c.Sink {
+	case "":
+		return nil, nil
+	case auditSinkFile:
+		if c.File.Path == "" {
+			return nil, errors.New("audit.file.path must be set for the file sink")
+		}
+		maxSizeMB := c.File.MaxSizeMB
+		if maxSizeMB <= 0 {
+			maxSizeMB = defaultAuditMaxSizeMB
+		}
+		maxBackups := c.File.MaxBackups
+		if maxBackups <= 0 {
+			maxBackups = defaultAuditMaxBackups
+		}
+		fileSink, err := newFileAuditSink(c.File.Path, int64(maxSizeMB)*1024*1024, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink = fileSink
+	case auditSinkHTTP:
+		if c.HTTP.URL == "" {
+			return nil, errors.New("audit.http.url must be set for the http sink")
+		}
+		timeout := defaultAuditHTTPTimeout
+		if c.HTTP.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(c.HTTP.Timeout); err != nil {
+				return nil, fmt.Errorf("audit.http.timeout: %v", err)
+			}
+		}
+		sink = &httpAuditSink{url: c.HTTP.URL, client: &http.Client{Timeout: timeout}}
+	default:
+		return nil, fmt.Errorf("audit.sink: unknown sink %v, use %v or %v", c.Sink, auditSinkFile, auditSinkHTTP)
+	}
+
+	bufferSize := c.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultAuditBufferSize
+	}
+	a := &auditor{sink: sink, includeDryRun: c.IncludeDryRun, records: make(chan *auditRecord, bufferSize), abort: make(chan struct{}), done: make(chan struct{})}
+	go a.run()
+	return a, nil
+}
+
+// record queues the record for the sink without blocking, dry runs are skipped unless audit.includeDryRun is set. It is
+// safe to call on a nil auditor, and after close, when the record is dropped.
+func (a *auditor) record(r *auditRecord) {
+	if a == nil || (r.DryRun && !a.includeDryRun) {
+		return
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		auditRecordsTotal.WithLabelValues("dropped").Inc()
+		logger.WithField("uid", r.UID).Warn("audit trail is closed, dropping audit record")
+		return
+	}
+	select {
+	case a.records <- r:
+	default:
+		auditRecordsTotal.WithLabelValues("dropped").Inc()
+		logger.WithField("uid", r.UID).Warn("audit buffer is full, dropping audit record")
+	}
+}
+
+// run writes queued records to the sink until the auditor is closed, and then closes the sink. The sink is closed here,
+// not by close, so that it is never closed while a record is being written to it.
+func (a *auditor) run() {
+	defer close(a.done)
+	for r := range a.records {
+		select {
+		case <-a.abort:
+			auditRecordsTotal.WithLabelValues("dropped").Inc()
+			continue
+		default:
+		}
+		if err := a.sink.Write(r); err != nil {
+			auditRecordsTotal.WithLabelValues("failed").Inc()
+			logger.WithField("uid", r.UID).WithError(err).Error("could not write audit record")
+			continue
+		}
+		auditRecordsTotal.WithLabelValues("written").Inc()
+	}
+	if err := a.sink.Close(); err != nil {
+		logger.WithError(err).Error("could not close audit sink")
+	}
+}
+
+// close writes the records still queued and closes the sink, waiting at most until the timeout. On timeout the records
+// not yet written are dropped and the sink is closed once the record being written is done. Records of requests still
+// in flight when the server shutdown timed out are dropped too, close may be called more than once.
+func (a *auditor) close(timeout time.Duration) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.records)
+	a.mu.Unlock()
+
+	select {
+	case <-a.done:
+	case <-time.After(timeout):
+		logger.Warnf("audit records still queued after %v, dropping them", timeout)
+		close(a.abort)
+	}
+}
+
+// fileAuditSink appends records as JSON lines to a file and rotates it by size.
+type fileAuditSink struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func newFileAuditSink(path string, maxSize int64, maxBackups int) (*fileAuditSink, error) {
+	s := &fileAuditSink{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the audit file for appending, creating it if needed.
+func (s *fileAuditSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return fmt.Errorf("could not open audit file: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not open audit file: %v", err)
+	}
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileAuditSink) Write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	if s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, moves the current file to path.1 and opens a new one. If the
+// file cannot be moved or the new one opened, the sink keeps appending to path, so that a failed rotation does not lose
+// every later record. The rotation is then tried again once another maxSize has been written.
+func (s *fileAuditSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return s.reopen(fmt.Errorf("could not rotate audit file: %v", err))
+	}
+	os.Remove(fmt.Sprintf("%v.%d", s.path, s.maxBackups))
+	for i := s.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%v.%d", s.path, i), fmt.Sprintf("%v.%d", s.path, i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return s.reopen(fmt.Errorf("could not rotate audit file: %v", err))
+	}
+	if err := s.open(); err != nil {
+		return s.reopen(err)
+	}
+	return nil
+}
+
+// reopen opens path again after a failed rotation and returns the rotation error, which is logged by the caller. The
+// record is still written if path can be opened.
+func (s *fileAuditSink) reopen(rotateErr error) error {
+	if err := s.open(); err != nil {
+		return fmt.Errorf("%v, could not reopen it: %v", rotateErr, err)
+	}
+	logger.WithError(rotateErr).Error("could not rotate audit file, appending to it")
+	s.size = 0
+	return nil
+}
+
+func (s *fileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// httpAuditSink POSTs every record as JSON to a collector.
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *httpAuditSink) Write(record *auditRecord) error {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, jsonContentType, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so that the connection can be reused
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("audit collector %v answered %v", s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpAuditSink) Close() error {
+	return nil
+}
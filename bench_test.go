@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+// BenchmarkHandlers measures the latency and allocations of every handler with the sample objects of the readiness
+// self-check, both for a complete HTTP request and for the handler alone. The config is loaded from the config
+// directory for the profile in PROFILE, run it with go test -bench . -benchmem.
+func BenchmarkHandlers(b *testing.B) {
+	cfg, err := loadProfileConfig(os.Getenv("PROFILE"), false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	setConfig(cfg)
+	namespace := sampleNamespace(cfg)
+
+	for _, h := range admitHandlers {
+		review, err := h.sampleReview(namespace)
+		if err != nil {
+			b.Fatalf("%v: %v", h, err)
+		}
+		_, req, err := decodeAdmissionReview(review)
+		if err != nil {
+			b.Fatalf("%v: %v", h, err)
+		}
+		req.log = requestLogger(admitPath, req)
+
+		handler := admitFuncHandler(admitByKind)
+		serve := func() int {
+			r := httptest.NewRequest(http.MethodPost, admitPath, bytes.NewReader(review))
+			r.Header.Set("Content-Type", jsonContentType)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			return w.Code
+		}
+		// a request that fails would only measure the error path
+		if code := serve(); code != http.StatusOK {
+			b.Fatalf("%v: sample request answered %v", h, code)
+		}
+
+		// the networking.k8s.io/v1beta1 Ingress handler is reported as Ingress.networking.k8s.io
+		name := h.kind.Kind
+		if h.kind.Group != "" {
+			name += "." + h.kind.Group
+		}
+		b.Run(name+"/request", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				serve()
+			}
+		})
+		b.Run(name+"/admit", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				evaluateRequest(cfg, admitByKind, req)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// certPollInterval is how often the certificate files are checked for changes. Secrets are updated in the pod by
+	// an atomic symlink swap, same as the config ConfigMap.
+	certPollInterval = 10 * time.Second
+	// certExpiryWarning is how long before expiry the served certificate starts being logged as expiring.
+	certExpiryWarning = 30 * 24 * time.Hour
+	// certExpiryWarningInterval limits the expiry warning to one log line per interval.
+	certExpiryWarningInterval = time.Hour
+)
+
+// certLoader serves the TLS key pair found in certPath and keyPath, and reloads it when the files change so that a
+// rotated secret is picked up without a restart.
+type certLoader struct {
+	certPath string
+	keyPath  string
+	// cert holds the *tls.Certificate currently served
+	cert atomic.Value
+	hash [sha256.Size]byte
+}
+
+// newCertLoader loads the key pair, it fails if the files cannot be read or parsed because the server cannot serve
+// anything without a certificate.
+func newCertLoader(certPath string, keyPath string) (*certLoader, error) {
+	l := &certLoader{certPath: certPath, keyPath: keyPath}
+	hash, err := l.fileHash()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	l.hash = hash
+	return l, nil
+}
+
+// GetCertificate returns the current certificate, it is used as tls.Config.GetCertificate.
+func (l *certLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return l.cert.Load().(*tls.Certificate), nil
+}
+
+// fileHash returns a sha256 over the contents of the certificate and key files.
+func (l *certLoader) fileHash() ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	certPEM, err := ioutil.ReadFile(l.certPath)
+	if err != nil {
+		return hash, err
+	}
+	keyPEM, err := ioutil.ReadFile(l.keyPath)
+	if err != nil {
+		return hash, err
+	}
+	return sha256.Sum256(append(append(certPEM, 0), keyPEM...)), nil
+}
+
+// load parses the key pair and makes it the served certificate.
+func (l *certLoader) load() error {
+	cert, err := tls.LoadX509KeyPair(l.certPath, l.keyPath)
+	if err != nil {
+		return fmt.Errorf("could not load key pair %v %v: %v", l.certPath, l.keyPath, err)
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("no certificate found in " + l.certPath)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("could not parse certificate %v: %v", l.certPath, err)
+	}
+	cert.Leaf = leaf
+
+	l.cert.Store(&cert)
+	certExpiryTimestamp.Set(float64(leaf.NotAfter.Unix()))
+	logger.WithFields(logrus.Fields{
+		"subject": leaf.Subject.String(),
+		"serial":  leaf.SerialNumber.String(),
+		"expires": leaf.NotAfter.UTC(),
+	}).Info("Serving certificate")
+	return nil
+}
+
+// leaf returns the parsed certificate currently served.
+func (l *certLoader) leaf() *x509.Certificate {
+	return l.cert.Load().(*tls.Certificate).Leaf
+}
+
+// watch polls the certificate files and reloads the key pair whenever they change. A key pair that fails to load is
+// logged and the previous certificate stays in use until the files change again.
+// It also warns while the served certificate is close to expiry. It never returns.
+func (l *certLoader) watch(interval time.Duration) {
+	var lastWarning time.Time
+	for range time.Tick(interval) {
+		hash, err := l.fileHash()
+		if err != nil {
+			logger.WithError(err).Error("could not read certificate")
+		} else if hash != l.hash {
+			l.hash = hash
+			if err := l.load(); err != nil {
+				logger.WithError(err).Error("certificate change rejected, keeping the previous certificate")
+			} else {
+				lastWarning = time.Time{}
+			}
+		}
+
+		notAfter := l.leaf().NotAfter
+		if remaining := time.Until(notAfter); remaining < certExpiryWarning && time.Since(lastWarning) >= certExpiryWarningInterval {
+			logger.WithField("expires", notAfter.UTC()).Warnf("served certificate expires in %v, rotate the certificate secret", remaining.Round(time.Minute))
+			lastWarning = time.Now()
+		}
+	}
+}
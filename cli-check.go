@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// checkUser is the user name of the synthetic admission requests built by the check command.
+const checkUser = "admission-control-check"
+
+// stringList is a flag that may be given more than once.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// manifest is one object read from a manifest file.
+type manifest struct {
+	// file is the path the object was read from and source adds its document number and List item index
+	file      string
+	source    string
+	raw       []byte
+	gvk       metav1.GroupVersionKind
+	name      string
+	namespace string
+}
+
+// checkResult is the outcome of running one manifest through the webhook's handler for its kind.
+type checkResult struct {
+	manifest *manifest
+	// endpoint is the webhook path whose handler checked the object, empty if no handler serves its kind
+	endpoint  string
+	namespace string
+	verdict
+}
+
+// runCheck implements `admission-control check`, it lints manifests with the rules of the webhook and returns the
+// exit code: 0 if every object would be admitted, 1 if any would be rejected or has no namespace to be checked in and 2
+// if the check could not run.
+func runCheck(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	var paths stringList
+	flags.Var(&paths, "f", "manifest file or directory of .yaml, .yml and .json files, may be repeated")
+	profile := flags.String("profile", os.Getenv("PROFILE"), "config profile, config/global.json and config/<profile>.json are loaded")
+	namespace := flags.String("namespace", "", "namespace of objects that do not set metadata.namespace, objects without either are not checked and fail the check")
+	format := flags.String("format", reportFormatText, "report format: text, json, sarif or junit")
+	output := flags.String("o", "", "write the report to this file instead of stdout")
+	verbose := flags.Bool("v", false, "write the webhook log to stderr")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: admission-control check -f <file or dir> [-f ...] [--profile dev] [--namespace ns] [--format text|json|sarif|junit] [-o file] [-v]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(paths) == 0 {
+		flags.Usage()
+		return 2
+	}
+	writeReport, ok := reportFormats[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "check: unknown format %v, use text, json, sarif or junit\n", *format)
+		return 2
+	}
+
+	cfg, err := loadProfileConfig(*profile, *verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		return 2
+	}
+
+	manifests, err := readManifests(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "check: %v\n", err)
+		return 2
+	}
+
+	exitCode := 0
+	results := make([]*checkResult, 0, len(manifests))
+	for _, m := range manifests {
+		result := checkManifest(cfg, m, *namespace)
+		results = append(results, result)
+		if result.decision != decisionAllowed {
+			exitCode = 1
+		}
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "check: %v\n", err)
+			return 2
+		}
+		defer f.Close()
+		out = f
+	}
+	if err := writeReport(out, cfg, results); err != nil {
+		fmt.Fprintf(os.Stderr, "check: could not write report: %v\n", err)
+		return 2
+	}
+	return exitCode
+}
+
+// loadProfileConfig loads the config of the given profile from the config directory of the working directory. The
+// webhook log is discarded unless verbose is set, the command prints its own results.
+func loadProfileConfig(profile string, verbose bool) (*Config, error) {
+	if verbose {
+		logger.SetOutput(os.Stderr)
+	} else {
+		logger.SetOutput(ioutil.Discard)
+	}
+	os.Setenv("PROFILE", profile)
+	cfg, err := loadConfig()
+	if cfg == nil {
+		return nil, fmt.Errorf("could not load config: %v", err)
+	} else if err != nil {
+		return nil, err
+	}
+	if err := configureLogger(cfg.Logging); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readManifests reads every object from the files, directories are searched recursively for .yaml, .yml and .json
+// files. Lists are expanded into their items.
+func readManifests(paths []string) ([]*manifest, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".yaml", ".yml", ".json":
+				files = append(files, path)
+			default:
+				// a file named explicitly is read whatever its extension
+				if path == p {
+					files = append(files, path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var manifests []*manifest
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		m, err := decodeManifests(file, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, m...)
+	}
+	return manifests, nil
+}
+
+// decodeManifests splits a multi-document YAML or JSON stream into objects.
+func decodeManifests(file string, r io.Reader) ([]*manifest, error) {
+	var manifests []*manifest
+	decoder := utilyaml.NewYAMLOrJSONDecoder(r, 4096)
+	for doc := 1; ; doc++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return manifests, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%v document %d: %v", file, doc, err)
+		}
+		// skip empty documents, such as a trailing ---
+		if len(bytes.TrimSpace(raw)) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			continue
+		}
+		objects, err := newManifests(fmt.Sprintf("%v#%d", file, doc), raw)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range objects {
+			m.file = file
+		}
+		manifests = append(manifests, objects...)
+	}
+}
+
+// newManifests reads the identity of the object, a List yields one manifest per item.
+func newManifests(source string, raw []byte) ([]*manifest, error) {
+	var obj struct {
+		metav1.TypeMeta
+		Metadata metav1.ObjectMeta `json:"metadata"`
+		Items    []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, fmt.Errorf("%v: %v", source, err)
+	}
+	if obj.Kind == "" || obj.APIVersion == "" {
+		return nil, fmt.Errorf("%v: apiVersion and kind must be set", source)
+	}
+
+	if strings.HasSuffix(obj.Kind, "List") && obj.Items != nil {
+		var manifests []*manifest
+		for i, item := range obj.Items {
+			m, err := newManifests(fmt.Sprintf("%v[%d]", source, i), item)
+			if err != nil {
+				return nil, err
+			}
+			manifests = append(manifests, m...)
+		}
+		return manifests, nil
+	}
+
+	gv, err := schema.ParseGroupVersion(obj.APIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", source, err)
+	}
+	return []*manifest{{
+		source:    source,
+		raw:       raw,
+		gvk:       metav1.GroupVersionKind{Group: gv.Group, Version: gv.Version, Kind: obj.Kind},
+		name:      obj.Metadata.Name,
+		namespace: obj.Metadata.Namespace,
+	}}, nil
+}
+
+// checkManifest runs the object through the handler for its kind as a CREATE, exactly like the webhook would
+// evaluate it, including the rule modes configured for its namespace.
+func checkManifest(cfg *Config, m *manifest, defaultNamespace string) *checkResult {
+	result := &checkResult{manifest: m, namespace: m.namespace, verdict: verdict{decision: decisionAllowed}}
+	if result.namespace == "" {
+		result.namespace = defaultNamespace
+	}
+	h := handlerFor(m.gvk, "")
+	if h == nil {
+		return result
+	}
+	result.endpoint = admitPath
+	// the rules are selected by namespace, an object without one would pass unchecked
+	if result.namespace == "" {
+		result.decision = decisionError
+		result.err = fmt.Errorf("not checked, metadata.namespace is not set, give the namespace it is applied to with --namespace")
+		return result
+	}
+
+	req := &admissionRequest{
+		UID:       types.UID("check-" + m.source),
+		Kind:      m.gvk,
+		Resource:  h.resource,
+		Name:      m.name,
+		Namespace: result.namespace,
+		Operation: operationCreate,
+		UserInfo:  authenticationv1.UserInfo{Username: checkUser},
+		Object:    runtime.RawExtension{Raw: m.raw},
+	}
+	req.log = requestLogger(admitPath, req)
+	result.verdict = evaluateRequest(cfg, admitByKind, req)
+	return result
+}
+
+// objectID names the checked object as Kind namespace/name.
+func (r *checkResult) objectID() string {
+	m := r.manifest
+	if r.namespace == "" {
+		return fmt.Sprintf("%v %v", m.gvk.Kind, m.name)
+	}
+	return fmt.Sprintf("%v %v/%v", m.gvk.Kind, r.namespace, m.name)
+}
+
+// printCheckResult writes the result in a human readable form.
+func printCheckResult(w io.Writer, r *checkResult) {
+	m := r.manifest
+	id := r.objectID()
+	if r.endpoint == "" {
+		fmt.Fprintf(w, "%v: %v: not checked, the webhook does not admit %v\n", m.source, id, m.gvk)
+		return
+	}
+
+	fmt.Fprintf(w, "%v: %v: %v\n", m.source, id, strings.ToUpper(r.decision))
+	if r.err != nil {
+		fmt.Fprintf(w, "  error: %v\n", r.err)
+	}
+	for _, v := range r.violations {
+		fmt.Fprintf(w, "  %v %v: %v\n", v.Mode, v.Rule, v.Message)
+	}
+	if len(r.patchOps) > 0 {
+		patch, err := json.MarshalIndent(r.patchOps, "  ", "  ")
+		if err != nil {
+			fmt.Fprintf(w, "  patch: %v\n", err)
+			return
+		}
+		fmt.Fprintf(w, "  patch: %s\n", patch)
+	}
+}
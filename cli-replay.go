@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// capturedReview is one AdmissionReview read from a capture file.
+type capturedReview struct {
+	// source is the file and the number of the review in it
+	source string
+	req    *admissionRequest
+}
+
+// replayDiff is how the verdicts of one review differ between the current and the candidate config.
+type replayDiff struct {
+	review    *capturedReview
+	current   verdict
+	candidate verdict
+	// removed and added are the violations only found under the current and only under the candidate config
+	removed []string
+	added   []string
+	// patchChanged is set if the patches differ, currentPatch and candidatePatch are then the redacted patches
+	patchChanged   bool
+	currentPatch   string
+	candidatePatch string
+}
+
+// changed reports whether the candidate config decides the review differently in any way.
+func (d *replayDiff) changed() bool {
+	return d.current.decision != d.candidate.decision || len(d.removed) > 0 || len(d.added) > 0 ||
+		d.patchChanged
+}
+
+// runReplay implements `admission-control replay`, it evaluates captured AdmissionReviews under the current and a
+// candidate config and prints every review whose verdict, violations or patch would change. It returns 0 if nothing
+// changes, 1 if anything does and 2 if the replay could not run.
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	var paths stringList
+	flags.Var(&paths, "f", "AdmissionReview JSON file, JSONL file or directory of .json and .jsonl files, may be repeated")
+	profile := flags.String("profile", os.Getenv("PROFILE"), "current config profile, config/global.json and config/<profile>.json are loaded")
+	candidate := flags.String("candidate", "", "candidate config profile, config/global.json and config/<candidate>.json are loaded")
+	verbose := flags.Bool("v", false, "write the webhook log to stderr")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: admission-control replay -f <file or dir> [-f ...] [--profile prod] --candidate prod-next [-v]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if len(paths) == 0 || *candidate == "" {
+		flags.Usage()
+		return 2
+	}
+
+	currentCfg, err := loadProfileConfig(*profile, *verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: current config: %v\n", err)
+		return 2
+	}
+	candidateCfg, err := loadProfileConfig(*candidate, *verbose)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: candidate config: %v\n", err)
+		return 2
+	}
+
+	reviews, err := readCapturedReviews(paths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay: %v\n", err)
+		return 2
+	}
+
+	var changed, denied, allowed, skipped int
+	for _, review := range reviews {
+		if handlerFor(review.req.Kind, review.req.SubResource) == nil {
+			skipped++
+			continue
+		}
+		review.req.log = requestLogger(admitPath, review.req)
+		d := newReplayDiff(review, evaluateRequest(currentCfg, admitByKind, review.req),
+			evaluateRequest(candidateCfg, admitByKind, review.req), currentCfg, candidateCfg)
+		if !d.changed() {
+			continue
+		}
+		changed++
+		if d.current.decision == decisionAllowed && d.candidate.decision != decisionAllowed {
+			denied++
+		} else if d.current.decision != decisionAllowed && d.candidate.decision == decisionAllowed {
+			allowed++
+		}
+		printReplayDiff(os.Stdout, d)
+	}
+
+	fmt.Printf("replayed %d review(s): %d changed (%d newly rejected, %d newly allowed), %d unchanged, %d not admitted by the webhook\n",
+		len(reviews), changed, denied, allowed, len(reviews)-changed-skipped, skipped)
+	if changed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// readCapturedReviews reads every AdmissionReview from the files, directories are searched recursively for .json and
+// .jsonl files. A file may hold a single review or a stream of them, such as one review per line.
+func readCapturedReviews(paths []string) ([]*capturedReview, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			switch strings.ToLower(filepath.Ext(path)) {
+			case ".json", ".jsonl":
+				files = append(files, path)
+			default:
+				// a file named explicitly is read whatever its extension
+				if path == p {
+					files = append(files, path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var reviews []*capturedReview
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		r, err := decodeCapturedReviews(file, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		reviews = append(reviews, r...)
+	}
+	return reviews, nil
+}
+
+// decodeCapturedReviews decodes a stream of AdmissionReview JSON documents of any supported version.
+func decodeCapturedReviews(file string, r io.Reader) ([]*capturedReview, error) {
+	var reviews []*capturedReview
+	decoder := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			return reviews, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%v review %d: %v", file, n, err)
+		}
+		_, req, err := decodeAdmissionReview(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%v review %d: %v", file, n, err)
+		}
+		reviews = append(reviews, &capturedReview{source: fmt.Sprintf("%v#%d", file, n), req: req})
+	}
+}
+
+// newReplayDiff compares the verdicts of the review under the current and the candidate config. Patches are compared
+// as returned to the apiserver but kept redacted with the config they were made with, for printing.
+func newReplayDiff(review *capturedReview, current verdict, candidate verdict, currentCfg *Config, candidateCfg *Config) *replayDiff {
+	d := &replayDiff{review: review, current: current, candidate: candidate}
+	d.removed, d.added = diffStrings(violationLines(current), violationLines(candidate))
+
+	currentPatch, _ := json.Marshal(current.patchOps)
+	candidatePatch, _ := json.Marshal(candidate.patchOps)
+	if !bytes.Equal(currentPatch, candidatePatch) {
+		d.patchChanged = true
+		d.currentPatch = redactedPatch(currentCfg, current.patchOps)
+		d.candidatePatch = redactedPatch(candidateCfg, candidate.patchOps)
+	}
+	return d
+}
+
+// violationLines formats the violations and the error of the verdict for comparison.
+func violationLines(v verdict) []string {
+	var lines []string
+	for _, violation := range v.violations {
+		lines = append(lines, fmt.Sprintf("%v %v: %v", violation.Mode, violation.Rule, violation.Message))
+	}
+	if v.err != nil {
+		lines = append(lines, fmt.Sprintf("error: %v", v.err))
+	}
+	return lines
+}
+
+// diffStrings returns the entries only in a and the entries only in b, in their original order.
+func diffStrings(a []string, b []string) ([]string, []string) {
+	count := map[string]int{}
+	for _, s := range a {
+		count[s]++
+	}
+	var added []string
+	for _, s := range b {
+		if count[s] > 0 {
+			count[s]--
+		} else {
+			added = append(added, s)
+		}
+	}
+	var removed []string
+	for _, s := range a {
+		if count[s] > 0 {
+			count[s]--
+			removed = append(removed, s)
+		}
+	}
+	return removed, added
+}
+
+// redactedPatch returns the patch as JSON with sensitive values masked, or "none" if there is no patch.
+func redactedPatch(cfg *Config, patchOps []patchOperation) string {
+	if len(patchOps) == 0 {
+		return "none"
+	}
+	b, err := json.Marshal(patchOps)
+	if err == nil {
+		b, err = cfg.redactObject(b)
+	}
+	if err != nil {
+		return fmt.Sprintf("could not redact patch: %v", err)
+	}
+	return string(b)
+}
+
+// printReplayDiff writes the changes of one review, lines starting with - are only seen under the current config and
+// lines starting with + only under the candidate config.
+func printReplayDiff(w io.Writer, d *replayDiff) {
+	req := d.review.req
+	id := fmt.Sprintf("%v %v", req.Kind.Kind, req.Name)
+	if req.Namespace != "" {
+		id = fmt.Sprintf("%v %v/%v", req.Kind.Kind, req.Namespace, req.Name)
+	}
+	decision := strings.ToUpper(d.current.decision)
+	if d.current.decision != d.candidate.decision {
+		decision = fmt.Sprintf("%v -> %v", decision, strings.ToUpper(d.candidate.decision))
+	}
+	fmt.Fprintf(w, "%v: %v %v (uid %v): %v\n", d.review.source, req.Operation, id, req.UID, decision)
+	for _, s := range d.removed {
+		fmt.Fprintf(w, "  - %v\n", s)
+	}
+	for _, s := range d.added {
+		fmt.Fprintf(w, "  + %v\n", s)
+	}
+	if d.patchChanged {
+		fmt.Fprintf(w, "  - patch: %v\n", d.currentPatch)
+		fmt.Fprintf(w, "  + patch: %v\n", d.candidatePatch)
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// report formats selectable with check --format
+const (
+	reportFormatText  = "text"
+	reportFormatJSON  = "json"
+	reportFormatSARIF = "sarif"
+	reportFormatJUnit = "junit"
+)
+
+// reportWriter writes the results of the check command in one report format.
+type reportWriter func(w io.Writer, cfg *Config, results []*checkResult) error
+
+// reportFormats maps every report format to its writer.
+var reportFormats = map[string]reportWriter{
+	reportFormatText:  writeTextReport,
+	reportFormatJSON:  writeJSONReport,
+	reportFormatSARIF: writeSARIFReport,
+	reportFormatJUnit: writeJUnitReport,
+}
+
+// writeTextReport writes the results in a human readable form.
+func writeTextReport(w io.Writer, cfg *Config, results []*checkResult) error {
+	for _, r := range results {
+		printCheckResult(w, r)
+	}
+	return nil
+}
+
+// jsonResult is the JSON report of one checked object.
+type jsonResult struct {
+	Source    string `json:"source"`
+	File      string `json:"file"`
+	Line      int    `json:"line,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	// Checked is false if the webhook does not admit the kind, such objects are always allowed
+	Checked    bool             `json:"checked"`
+	Endpoint   string           `json:"endpoint,omitempty"`
+	Decision   string           `json:"decision"`
+	Error      string           `json:"error,omitempty"`
+	Violations []jsonViolation  `json:"violations"`
+	Patch      []patchOperation `json:"patch,omitempty"`
+}
+
+// jsonViolation is a violation together with the line of the offending field.
+type jsonViolation struct {
+	violation
+	Line int `json:"line,omitempty"`
+}
+
+// writeJSONReport writes the results as a JSON document with one entry per object.
+func writeJSONReport(w io.Writer, cfg *Config, results []*checkResult) error {
+	lines := newSourceIndex()
+	report := struct {
+		Results []jsonResult `json:"results"`
+	}{Results: make([]jsonResult, 0, len(results))}
+
+	for _, r := range results {
+		m := r.manifest
+		jr := jsonResult{
+			Source:     m.source,
+			File:       m.file,
+			Line:       lines.fieldLine(m, ""),
+			Kind:       m.gvk.Kind,
+			Namespace:  r.namespace,
+			Name:       m.name,
+			Checked:    r.endpoint != "",
+			Endpoint:   r.endpoint,
+			Decision:   r.decision,
+			Violations: []jsonViolation{},
+			Patch:      r.patchOps,
+		}
+		if r.err != nil {
+			jr.Error = r.err.Error()
+		}
+		for _, v := range r.violations {
+			jr.Violations = append(jr.Violations, jsonViolation{violation: v, Line: lines.fieldLine(m, v.Field)})
+		}
+		report.Results = append(report.Results, jr)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(report)
+}
+
+// SARIF 2.1.0 log, only the parts the check command fills in are modelled.
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+)
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool         `json:"tool"`
+	Invocations []sarifInvocation `json:"invocations"`
+	Results     []sarifResult     `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name  string      `json:"name"`
+	Rules []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+	Properties           map[string]string  `json:"properties,omitempty"`
+}
+
+type sarifConfiguration struct {
+	Enabled bool `json:"enabled"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful        bool                `json:"executionSuccessful"`
+	ToolExecutionNotifications []sarifNotification `json:"toolExecutionNotifications,omitempty"`
+}
+
+type sarifNotification struct {
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifResult struct {
+	RuleID     string            `json:"ruleId"`
+	RuleIndex  int               `json:"ruleIndex"`
+	Level      string            `json:"level"`
+	Message    sarifMessage      `json:"message"`
+	Locations  []sarifLocation   `json:"locations"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation  `json:"physicalLocation"`
+	LogicalLocations []sarifLogicalLocation `json:"logicalLocations,omitempty"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+type sarifLogicalLocation struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+// sarifLevels maps the rule modes to SARIF result levels, only enforced violations are errors.
+var sarifLevels = map[string]string{
+	modeEnforce: "error",
+	modeWarn:    "warning",
+	modeAudit:   "note",
+}
+
+// writeSARIFReport writes the results as a SARIF log with one result per violation, located at the line of the
+// offending field, so that code review tools can annotate the manifests. Objects that could not be checked are
+// reported as tool execution notifications.
+func writeSARIFReport(w io.Writer, cfg *Config, results []*checkResult) error {
+	lines := newSourceIndex()
+	run := sarifRun{
+		Tool:        sarifTool{Driver: sarifDriver{Name: "admission-control"}},
+		Invocations: []sarifInvocation{{ExecutionSuccessful: true}},
+		Results:     []sarifResult{},
+	}
+	ruleIndex := map[string]int{}
+	for i, r := range ruleRegistry {
+		ruleIndex[r.ID] = i
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+			ID:                   r.ID,
+			ShortDescription:     sarifMessage{Text: r.Description},
+			DefaultConfiguration: sarifConfiguration{Enabled: cfg.ruleEnabled(r.ID)},
+			Properties:           map[string]string{"resource": r.Resource},
+		})
+	}
+
+	for _, r := range results {
+		m := r.manifest
+		if r.err != nil {
+			run.Invocations[0].ToolExecutionNotifications = append(run.Invocations[0].ToolExecutionNotifications, sarifNotification{
+				Level:     "error",
+				Message:   sarifMessage{Text: fmt.Sprintf("%v: %v", r.objectID(), r.err)},
+				Locations: []sarifLocation{sarifLocationOf(r, lines.fieldLine(m, ""))},
+			})
+		}
+		for _, v := range r.violations {
+			level, ok := sarifLevels[v.Mode]
+			if !ok {
+				level = "error"
+			}
+			run.Results = append(run.Results, sarifResult{
+				RuleID:     v.Rule,
+				RuleIndex:  ruleIndex[v.Rule],
+				Level:      level,
+				Message:    sarifMessage{Text: fmt.Sprintf("%v: %v", r.objectID(), v.Message)},
+				Locations:  []sarifLocation{sarifLocationOf(r, lines.fieldLine(m, v.Field))},
+				Properties: map[string]string{"mode": v.Mode, "field": v.Field},
+			})
+		}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(sarifLog{Schema: sarifSchema, Version: sarifVersion, Runs: []sarifRun{run}})
+}
+
+// sarifLocationOf locates the line of the result's manifest file, the region is left out if the line is unknown.
+func sarifLocationOf(r *checkResult, line int) sarifLocation {
+	uri := (&url.URL{Path: filepath.ToSlash(r.manifest.file)}).String()
+	loc := sarifLocation{
+		PhysicalLocation: sarifPhysicalLocation{ArtifactLocation: sarifArtifactLocation{URI: uri}},
+		LogicalLocations: []sarifLogicalLocation{{Name: r.objectID(), Kind: "resource"}},
+	}
+	if line > 0 {
+		loc.PhysicalLocation.Region = &sarifRegion{StartLine: line}
+	}
+	return loc
+}
+
+// JUnit XML report, in the dialect understood by the common CI servers.
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string       `xml:"name,attr"`
+	Classname string       `xml:"classname,attr"`
+	File      string       `xml:"file,attr,omitempty"`
+	Line      int          `xml:"line,attr,omitempty"`
+	Failure   *junitResult `xml:"failure,omitempty"`
+	Error     *junitResult `xml:"error,omitempty"`
+	Skipped   *junitResult `xml:"skipped,omitempty"`
+	SystemOut string       `xml:"system-out,omitempty"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnitReport writes the results as JUnit XML with one test suite per file and one test case per object and
+// rule registered for its kind. Enforced violations fail the test case, warned and audited violations are only
+// reported as output. Objects the webhook does not admit or does not validate are skipped.
+func writeJUnitReport(w io.Writer, cfg *Config, results []*checkResult) error {
+	lines := newSourceIndex()
+	report := junitTestSuites{Name: "admission-control check"}
+	suites := map[string]int{}
+
+	for _, r := range results {
+		m := r.manifest
+		i, ok := suites[m.file]
+		if !ok {
+			i = len(report.Suites)
+			suites[m.file] = i
+			report.Suites = append(report.Suites, junitTestSuite{Name: m.file})
+		}
+		suite := &report.Suites[i]
+		for _, tc := range junitTestCases(cfg, r, lines) {
+			suite.Tests++
+			switch {
+			case tc.Failure != nil:
+				suite.Failures++
+			case tc.Error != nil:
+				suite.Errors++
+			case tc.Skipped != nil:
+				suite.Skipped++
+			}
+			suite.Cases = append(suite.Cases, tc)
+		}
+	}
+	for _, s := range report.Suites {
+		report.Tests += s.Tests
+		report.Failures += s.Failures
+		report.Errors += s.Errors
+		report.Skipped += s.Skipped
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// junitTestCases returns the test cases of one checked object.
+func junitTestCases(cfg *Config, r *checkResult, lines *sourceIndex) []junitTestCase {
+	m := r.manifest
+	objectCase := junitTestCase{Name: "admit", Classname: r.objectID(), File: m.file, Line: lines.fieldLine(m, "")}
+	if r.endpoint == "" {
+		objectCase.Skipped = &junitResult{Message: fmt.Sprintf("the webhook does not admit %v", m.gvk)}
+		return []junitTestCase{objectCase}
+	}
+	h := handlerFor(m.gvk, "")
+	var cases []junitTestCase
+	for _, rule := range ruleRegistry {
+		if rule.Resource != h.rules {
+			continue
+		}
+		tc := objectCase
+		tc.Name = rule.ID
+		switch {
+		case !cfg.ruleEnabled(rule.ID):
+			tc.Skipped = &junitResult{Message: "rule is disabled"}
+		case isKubeNamespace(r.namespace) || !cfg.namespaceIsMonitored(r.namespace):
+			tc.Skipped = &junitResult{Message: fmt.Sprintf("namespace %v is exempt from webhook validation", r.namespace)}
+		case r.err != nil:
+			tc.Error = &junitResult{Message: r.err.Error()}
+		default:
+			var enforced []violation
+			var reported []string
+			for _, v := range r.violations {
+				if v.Rule != rule.ID {
+					continue
+				}
+				if tc.Line == objectCase.Line {
+					tc.Line = lines.fieldLine(m, v.Field)
+				}
+				if v.Mode == modeEnforce {
+					enforced = append(enforced, v)
+				} else {
+					reported = append(reported, fmt.Sprintf("%v %v: %v", v.Mode, v.Field, v.Message))
+				}
+			}
+			if len(enforced) > 0 {
+				details := make([]string, 0, len(enforced))
+				for _, v := range enforced {
+					details = append(details, fmt.Sprintf("%v: %v", v.Field, v.Message))
+				}
+				tc.Failure = &junitResult{Message: enforced[0].Message, Type: modeEnforce, Text: strings.Join(details, "\n")}
+			}
+			tc.SystemOut = strings.Join(reported, "\n")
+		}
+		cases = append(cases, tc)
+	}
+	return cases
+}
+
+// sourceIndex finds the line of a field in the manifest files, so that reports can point at the offending field. Files
+// are parsed once and only when a line is asked for.
+type sourceIndex struct {
+	// files holds the object nodes of every parsed file, in the order they appear
+	files map[string][]*yaml.Node
+	// objects holds the node found for every manifest, used marks the nodes already taken by a manifest so that
+	// identical objects in one file are told apart by their order
+	objects map[*manifest]*yaml.Node
+	used    map[*yaml.Node]bool
+}
+
+func newSourceIndex() *sourceIndex {
+	return &sourceIndex{files: map[string][]*yaml.Node{}, objects: map[*manifest]*yaml.Node{}, used: map[*yaml.Node]bool{}}
+}
+
+// fieldLine returns the line of the field path, such as spec.template.spec.containers[0].image, in the manifest's
+// file. A missing field is located at its closest existing parent and the empty path at the object itself. It returns
+// 0 if the object cannot be found in the file.
+func (s *sourceIndex) fieldLine(m *manifest, field string) int {
+	n := s.object(m)
+	if n == nil {
+		return 0
+	}
+	return nodeLine(n, field)
+}
+
+// object returns the node of the manifest's object in its file, or nil if it cannot be found.
+func (s *sourceIndex) object(m *manifest) *yaml.Node {
+	if n, ok := s.objects[m]; ok {
+		return n
+	}
+	nodes, ok := s.files[m.file]
+	if !ok {
+		nodes = parseObjectNodes(m.file)
+		s.files[m.file] = nodes
+	}
+	var found *yaml.Node
+	for _, n := range nodes {
+		if !s.used[n] && nodeIsManifest(n, m) {
+			found = n
+			s.used[n] = true
+			break
+		}
+	}
+	s.objects[m] = found
+	return found
+}
+
+// parseObjectNodes parses every document of the file and returns the mapping node of every object, Lists are expanded
+// into their items. Documents after a parse error are ignored, such files were rejected when reading the manifests.
+func parseObjectNodes(file string) []*yaml.Node {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var nodes []*yaml.Node
+	var collect func(n *yaml.Node)
+	collect = func(n *yaml.Node) {
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		if kind := mappingValue(n, "kind"); kind != nil && strings.HasSuffix(kind.Value, "List") {
+			if items := mappingValue(n, "items"); items != nil && items.Kind == yaml.SequenceNode {
+				for _, item := range items.Content {
+					collect(item)
+				}
+				return
+			}
+		}
+		nodes = append(nodes, n)
+	}
+
+	decoder := yaml.NewDecoder(f)
+	for {
+		doc := &yaml.Node{}
+		if err := decoder.Decode(doc); err != nil {
+			return nodes
+		}
+		if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+			collect(doc.Content[0])
+		}
+	}
+}
+
+// nodeIsManifest reports whether the node is the manifest's object, by its apiVersion, kind, name and namespace.
+func nodeIsManifest(n *yaml.Node, m *manifest) bool {
+	if scalarValue(n, "kind") != m.gvk.Kind {
+		return false
+	}
+	gv, err := schema.ParseGroupVersion(scalarValue(n, "apiVersion"))
+	if err != nil || gv.Group != m.gvk.Group || gv.Version != m.gvk.Version {
+		return false
+	}
+	return scalarValue(n, "metadata", "name") == m.name && scalarValue(n, "metadata", "namespace") == m.namespace
+}
+
+// scalarValue returns the value at the key path of nested mapping nodes, or "" if there is none.
+func scalarValue(n *yaml.Node, path ...string) string {
+	for _, key := range path {
+		if n = mappingValue(n, key); n == nil {
+			return ""
+		}
+	}
+	return n.Value
+}
+
+// mappingValue returns the value of the key in a mapping node, or nil if the node is no mapping or has no such key.
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	n = resolveAlias(n)
+	if n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return resolveAlias(n.Content[i+1])
+		}
+	}
+	return nil
+}
+
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	return n
+}
+
+// nodeLine follows the field path from the object node and returns the line of the deepest field found. Keys may
+// themselves contain dots, as annotation keys such as nginx.org/ssl-services do, so the longest key matching the
+// remaining path is followed.
+func nodeLine(n *yaml.Node, path string) int {
+	line := n.Line
+	for path != "" {
+		n = resolveAlias(n)
+		switch n.Kind {
+		case yaml.MappingNode:
+			match := -1
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				key := n.Content[i].Value
+				if path != key && !strings.HasPrefix(path, key+".") && !strings.HasPrefix(path, key+"[") {
+					continue
+				}
+				if match < 0 || len(key) > len(n.Content[match].Value) {
+					match = i
+				}
+			}
+			if match < 0 {
+				return line
+			}
+			key := n.Content[match]
+			line = key.Line
+			path = strings.TrimPrefix(path[len(key.Value):], ".")
+			n = n.Content[match+1]
+		case yaml.SequenceNode:
+			end := strings.Index(path, "]")
+			if !strings.HasPrefix(path, "[") || end < 0 {
+				return line
+			}
+			i, err := strconv.Atoi(path[1:end])
+			if err != nil || i < 0 || i >= len(n.Content) {
+				return line
+			}
+			n = n.Content[i]
+			line = n.Line
+			path = strings.TrimPrefix(path[end+1:], ".")
+		default:
+			return line
+		}
+	}
+	return line
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// runValidateConfig implements `admission-control validate-config`, it runs the validation the server runs at startup
+// and on every reload, and prints every problem and warning. It returns 0 if the config is valid, 1 if the server
+// would refuse it and 2 if it could not be read.
+func runValidateConfig(args []string) int {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	profile := flags.String("profile", os.Getenv("PROFILE"), "config profile, config/global.json and config/<profile>.json are loaded")
+	strict := flags.Bool("strict", false, "treat warnings as problems")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: admission-control validate-config [--profile dev] [--strict]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// the problems are printed below, the log would only repeat them
+	logger.SetOutput(ioutil.Discard)
+	os.Setenv("PROFILE", *profile)
+	cfg, err := readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "validate-config: could not load config: %v\n", err)
+		return 2
+	}
+
+	problems := configProblems(cfg)
+	warnings := configWarnings(cfg)
+	// a misspelled rule ID leaves the rule in a different state than intended, it fails --strict like any warning
+	for _, id := range cfg.unknownRuleIDs() {
+		warnings = append(warnings, fmt.Sprintf("rule %v is referenced in the config but does not exist", id))
+	}
+	for _, p := range problems {
+		fmt.Printf("error: %v\n", p)
+	}
+	for _, w := range warnings {
+		fmt.Printf("warning: %v\n", w)
+	}
+
+	if len(problems) > 0 || (*strict && len(warnings) > 0) {
+		fmt.Printf("config of profile %q is invalid: %d error(s), %d warning(s)\n", *profile, len(problems), len(warnings))
+		return 1
+	}
+	fmt.Printf("config of profile %q is valid: %d warning(s)\n", *profile, len(warnings))
+	return 0
+}
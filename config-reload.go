@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/krenaut1/goconfig"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// configDir is where goconfig reads global.json and the profile file from, relative to the working directory /app.
+	// The tools-dev-admit-config ConfigMap is mounted here.
+	configDir = "config"
+	// configPollInterval is how often configDir is checked for changes. A ConfigMap update reaches the pod by an atomic
+	// symlink swap, so polling the file contents is more reliable than file system events.
+	configPollInterval = 10 * time.Second
+)
+
+// activeConfig holds the *Config every request is evaluated against. It is replaced as a whole on reload and never
+// modified in place, so a request that loaded it keeps a consistent snapshot.
+var activeConfig atomic.Value
+
+// loadedConfig returns the config snapshot currently in effect.
+func loadedConfig() *Config {
+	cfg, _ := activeConfig.Load().(*Config)
+	if cfg == nil {
+		return &Config{}
+	}
+	return cfg
+}
+
+// setConfig makes cfg the config snapshot for all following requests.
+func setConfig(cfg *Config) {
+	activeConfig.Store(cfg)
+}
+
+// loadConfig reads the config files into a new Config and validates it. The config is returned together with the
+// validation error, so that the caller decides whether an invalid config is used. Warnings are only logged.
+func loadConfig() (*Config, error) {
+	cfg, err := readConfig()
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range configWarnings(cfg) {
+		logger.WithField("config_hash", cfg.version).Warn("config: " + w)
+	}
+	return cfg, validateConfig(cfg)
+}
+
+// readConfig reads the config files into a new Config and compiles its policy, without validating it.
+func readConfig() (*Config, error) {
+	version, err := configHash(configDir)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{version: version}
+	if err := goconfig.GoConfig(cfg); err != nil {
+		return nil, err
+	}
+	// the problems of the policy are reported by validateConfig
+	cfg.policy, _ = newPolicy(cfg)
+	return cfg, nil
+}
+
+// validateConfig returns an error listing every problem found by configProblems, or nil if there is none.
+func validateConfig(cfg *Config) error {
+	if problems := configProblems(cfg); len(problems) > 0 {
+		return fmt.Errorf("invalid config: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// configProblems checks everything that would otherwise only fail or silently weaken the policy while a request is
+// being evaluated: every regex must compile, every rule mode must be known, every server duration must parse,
+// exemptions must name a namespace/name, namespace prefixes must be unique and valid hosts must be DNS names.
+func configProblems(cfg *Config) []string {
+	// every regex must compile
+	_, problems := newPolicy(cfg)
+
+	checkMode := func(where string, mode string) {
+		switch mode {
+		case "", modeEnforce, modeWarn, modeAudit:
+		default:
+			problems = append(problems, fmt.Sprintf("%v: unknown mode %v", where, mode))
+		}
+	}
+	checkMode("rules.mode", cfg.Rules.Mode)
+	for _, id := range sortedKeys(cfg.Rules.Modes) {
+		checkMode(fmt.Sprintf("rules.modes[%v]", id), cfg.Rules.Modes[id])
+	}
+	prefixes := make([]string, 0, len(cfg.Rules.Namespaces))
+	for p := range cfg.Rules.Namespaces {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+	for _, p := range prefixes {
+		ns := cfg.Rules.Namespaces[p]
+		checkMode(fmt.Sprintf("rules.namespaces[%v].mode", p), ns.Mode)
+		for _, id := range sortedKeys(ns.Modes) {
+			checkMode(fmt.Sprintf("rules.namespaces[%v].modes[%v]", p, id), ns.Modes[id])
+		}
+	}
+
+	if _, err := cfg.Server.timeouts(); err != nil {
+		problems = append(problems, err.Error())
+	}
+	if _, _, err := cfg.Logging.levelAndFormat(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	exemptionLists := []struct {
+		name    string
+		entries []string
+	}{
+		{"exemptIngresses", cfg.ExemptIngresses},
+		{"exemptDeployments", cfg.ExemptDeployments},
+		{"exemptServices", cfg.ExemptServices},
+	}
+	for _, l := range exemptionLists {
+		for i, entry := range l.entries {
+			if err := validateExemption(entry); err != nil {
+				problems = append(problems, fmt.Sprintf("%v[%d]: %v", l.name, i, err))
+			}
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, prefix := range cfg.MonitorNamespaces {
+		if seen[prefix] {
+			problems = append(problems, fmt.Sprintf("monitorNamespaces[%d]: duplicate prefix %q", i, prefix))
+		}
+		seen[prefix] = true
+	}
+
+	for i, host := range cfg.ValidHosts {
+		var msgs []string
+		if strings.HasPrefix(host, "*.") {
+			msgs = validation.IsWildcardDNS1123Subdomain(host)
+		} else {
+			msgs = validation.IsDNS1123Subdomain(host)
+		}
+		if len(msgs) > 0 {
+			problems = append(problems, fmt.Sprintf("validHosts[%d]: %q is not a valid DNS name: %v", i, host, strings.Join(msgs, ", ")))
+		}
+	}
+
+	return problems
+}
+
+// validateExemption checks that an exemption entry is a namespace/name pair, which is the only form the exemption
+// checks match.
+func validateExemption(entry string) error {
+	parts := strings.Split(entry, "/")
+	if len(parts) != 2 {
+		return fmt.Errorf("%q must have the form namespace/name", entry)
+	}
+	if msgs := validation.IsDNS1123Label(parts[0]); len(msgs) > 0 {
+		return fmt.Errorf("%q: namespace is invalid: %v", entry, strings.Join(msgs, ", "))
+	}
+	if msgs := validation.IsDNS1123Subdomain(parts[1]); len(msgs) > 0 {
+		return fmt.Errorf("%q: name is invalid: %v", entry, strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+// configWarnings returns config entries that are valid but most likely not what was intended: namespace prefixes that
+// are covered by a shorter prefix, which makes the longer one redundant.
+func configWarnings(cfg *Config) []string {
+	var warnings []string
+	for i, prefix := range cfg.MonitorNamespaces {
+		if prefix == "" {
+			warnings = append(warnings, fmt.Sprintf("monitorNamespaces[%d]: the empty prefix monitors every namespace", i))
+			continue
+		}
+		for j, other := range cfg.MonitorNamespaces {
+			if i != j && other != "" && other != prefix && strings.HasPrefix(prefix, other) {
+				warnings = append(warnings, fmt.Sprintf("monitorNamespaces[%d]: prefix %q overlaps %q, it is already monitored", i, prefix, other))
+				break
+			}
+		}
+	}
+	return warnings
+}
+
+// sortedKeys returns the keys of m in sorted order, so that validation errors are reported in a stable order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// configHash returns a sha256 over the names and contents of the json files in dir.
+func configHash(dir string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	h := sha256.New()
+	for _, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%v %d\n", filepath.Base(f), len(b))
+		h.Write(b)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// watchConfig polls dir and reloads the config whenever its contents change. A config that fails to load or validate
+// is logged and discarded, the previous config stays in effect. It never returns.
+func watchConfig(dir string, interval time.Duration) {
+	lastHash, err := configHash(dir)
+	if err != nil {
+		logger.WithError(err).Errorf("could not read config dir %v", dir)
+	}
+	for range time.Tick(interval) {
+		hash, err := configHash(dir)
+		if err != nil {
+			logger.WithError(err).Errorf("could not read config dir %v", dir)
+			continue
+		}
+		if hash == lastHash {
+			continue
+		}
+		lastHash = hash
+
+		cfg, err := loadConfig()
+		if err != nil {
+			logger.WithField("config_hash", hash).WithError(err).Error("config change rejected, keeping the previous config")
+			observeConfigLoad(err)
+			continue
+		}
+		setConfig(cfg)
+		observeConfigLoad(nil)
+		// validateConfig checked the logging config, so this cannot fail
+		configureLogger(cfg.Logging)
+		logger.WithField("config_hash", hash).Info("config change loaded")
+		cfg.logRuleConfig()
+	}
+}
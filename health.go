@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// selfCheck runs the sample object of every endpoint through the same decode, evaluate and encode steps as a real
+// request, rule modes and patch verification included. Policy violations are expected and fine, any other error means
+// the handler cannot evaluate objects.
+func selfCheck(cfg *Config) error {
+	namespace := sampleNamespace(cfg)
+	var problems []string
+	for _, h := range admitHandlers {
+		if err := h.selfCheck(cfg, namespace); err != nil {
+			problems = append(problems, fmt.Sprintf("%v: %v", h, err))
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// sampleNamespace returns a monitored namespace for the sample objects, otherwise the handlers approve them without
+// evaluating a single rule.
+func sampleNamespace(cfg *Config) string {
+	namespace := "admit-self-check"
+	if len(cfg.MonitorNamespaces) > 0 {
+		namespace = cfg.MonitorNamespaces[0] + namespace
+	}
+	return namespace
+}
+
+// sampleReview returns a v1 AdmissionReview creating the handler's sample object in the given namespace.
+func (h *admitHandler) sampleReview(namespace string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"apiVersion": admissionV1APIVersion,
+		"kind":       admissionReviewKind,
+		"request": map[string]interface{}{
+			"uid":         "admit-self-check",
+			"kind":        h.kind,
+			"resource":    h.resource,
+			"subResource": h.subResource,
+			"name":        "admit-self-check",
+			"namespace":   namespace,
+			"operation":   operationCreate,
+			// the sample is never persisted, and the benchmarks must not count it as admitted
+			"dryRun":   true,
+			"userInfo": map[string]interface{}{},
+			"object":   json.RawMessage(h.sample),
+		},
+	})
+}
+
+// selfCheck evaluates the handler's sample object in the given namespace, dispatched by kind like a real request.
+func (h *admitHandler) selfCheck(cfg *Config, namespace string) error {
+	review, err := h.sampleReview(namespace)
+	if err != nil {
+		return err
+	}
+
+	apiVersion, req, err := decodeAdmissionReview(review)
+	if err != nil {
+		return err
+	}
+	req.log = requestLogger(admitPath, req)
+	v := evaluateRequest(cfg, admitByKind, req)
+	if v.decision == decisionError {
+		return v.err
+	}
+	resp := &admissionResponse{UID: req.UID, Allowed: v.decision == decisionAllowed, Warnings: v.warnings}
+	if len(v.patchOps) > 0 {
+		if resp.Patch, err = json.Marshal(v.patchOps); err != nil {
+			return err
+		}
+	}
+	_, err = encodeAdmissionReview(apiVersion, resp)
+	return err
+}
+
+// readiness tracks whether the webhook can be trusted with apiserver traffic: the config loaded and is valid, the TLS
+// key pair parsed and every handler evaluated its sample object.
+type readiness struct {
+	certs *certLoader
+
+	mu     sync.Mutex
+	ready  bool
+	reason string
+	// draining is set once the pod is told to stop, the webhook then stays not ready whatever the checks say
+	draining bool
+}
+
+// check runs every readiness check against the current config and records the result.
+func (r *readiness) check() {
+	reason := ""
+	cfg := loadedConfig()
+	if err := validateConfig(cfg); err != nil {
+		reason = err.Error()
+	} else if r.certs == nil || r.certs.leaf() == nil {
+		reason = "no TLS certificate loaded"
+	} else if err := selfCheck(cfg); err != nil {
+		reason = "self-check failed: " + err.Error()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.draining {
+		return
+	}
+	if reason == "" && !r.ready {
+		logger.Info("Readiness self-check passed, webhook is ready")
+	} else if reason != "" && reason != r.reason {
+		logger.WithField("reason", reason).Warn("Webhook is not ready")
+	}
+	r.ready = reason == ""
+	r.reason = reason
+}
+
+// drain permanently reports the webhook as not ready, so that the endpoint is removed from the Service before the
+// server shuts down.
+func (r *readiness) drain() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.draining = true
+	r.ready = false
+	r.reason = "shutting down"
+}
+
+// status returns whether the webhook is ready, and why not.
+func (r *readiness) status() (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready, r.reason
+}
+
+// watch repeats the checks until they pass, a config that was invalid at startup can be fixed without a restart. Once
+// ready the webhook stays ready until it drains, invalid config changes are never swapped in. It never returns.
+func (r *readiness) watch(interval time.Duration) {
+	r.check()
+	for range time.Tick(interval) {
+		if ready, _ := r.status(); !ready {
+			r.check()
+		}
+	}
+}
+
+// healthzHandler answers the liveness probe, the process is alive as long as it serves HTTP.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// readyzHandler answers the readiness probe with 503 and the reason until every readiness check has passed.
+func (r *readiness) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	if ready, reason := r.status(); !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(reason))
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// log formats selectable with logging.format
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// logger writes every log line of the webhook. Lines about a request are written through the request's entry, see
+// requestLogger, so that they carry the fields identifying the request.
+var logger = newLogger()
+
+func newLogger() *logrus.Logger {
+	l := logrus.New()
+	l.SetFormatter(&logrus.JSONFormatter{})
+	return l
+}
+
+// configureLogger applies the level and format of the logging config, the json format and info level are used when
+// they are not set.
+func configureLogger(c LoggingConfig) error {
+	level, format, err := c.levelAndFormat()
+	if err != nil {
+		return err
+	}
+	logger.SetLevel(level)
+	if format == logFormatText {
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	} else {
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	}
+	return nil
+}
+
+// levelAndFormat parses the configured log level and format.
+func (c LoggingConfig) levelAndFormat() (logrus.Level, string, error) {
+	level := logrus.InfoLevel
+	if c.Level != "" {
+		var err error
+		if level, err = logrus.ParseLevel(c.Level); err != nil {
+			return level, "", fmt.Errorf("logging.level: %v", err)
+		}
+	}
+	switch c.Format {
+	case "":
+		return level, logFormatJSON, nil
+	case logFormatJSON, logFormatText:
+		return level, c.Format, nil
+	default:
+		return level, "", fmt.Errorf("logging.format: unknown format %v, use %v or %v", c.Format, logFormatJSON, logFormatText)
+	}
+}
+
+// requestLogger returns the entry every line about the request is logged with.
+func requestLogger(endpoint string, req *admissionRequest) *logrus.Entry {
+	return logger.WithFields(logrus.Fields{
+		"uid":       req.UID,
+		"kind":      req.Kind.Kind,
+		"namespace": req.Namespace,
+		"name":      req.Name,
+		"operation": req.Operation,
+		"dry_run":   req.isDryRun(),
+		"user":      req.UserInfo.Username,
+		"endpoint":  endpoint,
+	})
+}
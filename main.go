@@ -1,10 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"log"
 	"net/http"
+	"os"
 
-	"github.com/krenaut1/goconfig"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
 )
 
 // Config must match config file layout
@@ -18,31 +21,102 @@ type Config struct {
 	NginxMinionIngressAllow          map[string]string
 	IngressMinionRequiredAnnotations map[string]string
 	IngressMinionRequiredLabels      map[string]string
+	Rules                            RulesConfig
+	Resources                        ResourcesConfig
+	Server                           ServerConfig
+	Logging                          LoggingConfig
+	Audit                            AuditConfig
+
+	// version is the hash of the config files the config was loaded from, it is recorded with every audit record
+	version string
+	// policy is the compiled config every request is evaluated with, see compiled
+	policy *policy
 }
 
-var config Config
+// commands are run instead of the webhook server when named as the first argument, they return the exit code.
+var commands = map[string]func(args []string) int{
+	"check":           runCheck,
+	"replay":          runReplay,
+	"validate-config": runValidateConfig,
+}
 
 func main() {
-	// load application properties
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
 
-	err := goconfig.GoConfig(&config)
+	// load application properties
+	cfg, err := loadConfig()
+	observeConfigLoad(err)
+	if cfg == nil {
+		logger.WithError(err).Fatal("could not load config")
+	}
+	// refuse to start with an invalid config, the rules it weakens would otherwise go unnoticed
 	if err != nil {
-		log.Fatalf("Err thrown: %v\n", err)
+		logger.WithError(err).Fatal("config is invalid, refusing to start")
 	}
+	if err := configureLogger(cfg.Logging); err != nil {
+		logger.WithError(err).Fatal("invalid logging config")
+	}
+	setConfig(cfg)
+	cfg.logRuleConfig()
+	// pick up changes to the config files without a restart
+	go watchConfig(configDir, configPollInterval)
 
 	mux := http.NewServeMux()
-	mux.Handle("/admit-pod", admitFuncHandler(admitPod))
-	mux.Handle("/admit-deploy", admitFuncHandler(admitDeploy))
-	mux.Handle("/admit-ing-net", admitFuncHandler(admitIngressNet))
-	mux.Handle("/admit-ing-ext", admitFuncHandler(admitIngressExt))
-	mux.Handle("/admit-svc", admitFuncHandler(admitSvc))
+	// every path dispatches by kind, the per-kind paths are kept for existing webhook configurations
+	mux.Handle(admitPath, admitFuncHandler(admitByKind))
+	for _, h := range admitHandlers {
+		if h.alias != "" {
+			mux.Handle(h.alias, admitFuncHandler(admitByKind))
+		}
+	}
+
+	certPath := "/run/secrets/tls/cert.pem"
+	keyPath := "/run/secrets/tls/key.pem"
+	certs, err := newCertLoader(certPath, keyPath)
+	if err != nil {
+		logger.WithError(err).Fatal("could not load certificate")
+	}
+	// pick up a rotated certificate without a restart
+	go certs.watch(certPollInterval)
+
+	timeouts, err := cfg.Server.timeouts()
+	if err != nil {
+		logger.WithError(err).Fatal("invalid server timeouts")
+	}
 	server := &http.Server{
 		// We listen on port 8443 such that we do not need root privileges or extra capabilities for this server.
 		// The Service object will take care of mapping this port to the HTTPS port 443.
-		Addr:    ":8443",
-		Handler: mux,
+		Addr:         ":8443",
+		Handler:      mux,
+		TLSConfig:    &tls.Config{GetCertificate: certs.GetCertificate},
+		ReadTimeout:  timeouts.read,
+		WriteTimeout: timeouts.write,
+		IdleTimeout:  timeouts.idle,
+		// TLS handshake and connection errors are logged as structured warnings too
+		ErrorLog: log.New(logger.WriterLevel(logrus.WarnLevel), "", 0),
 	}
-	certPath := "/run/secrets/tls/cert.pem"
-	keyPath := "/run/secrets/tls/key.pem"
-	log.Fatal(server.ListenAndServeTLS(certPath, keyPath))
+	// record every admission decision, the webhook keeps running without an audit trail if the sink cannot be set up
+	if auditTrail, err = newAuditor(cfg.Audit); err != nil {
+		logger.WithError(err).Error("could not set up the audit sink, audit trail is off")
+	}
+
+	// readiness turns green once the config, the certificate and every handler have been checked
+	ready := &readiness{certs: certs, reason: "readiness self-check has not run yet"}
+	go ready.watch(configPollInterval)
+
+	// Metrics and probes are served over plain HTTP on their own port, so that prometheus and the kubelet do not need
+	// the webhook certificate and the admission port is not exposed to scrapers.
+	opsMux := http.NewServeMux()
+	opsMux.Handle("/metrics", promhttp.Handler())
+	opsMux.HandleFunc("/healthz", healthzHandler)
+	opsMux.HandleFunc("/readyz", ready.readyzHandler)
+	go func() {
+		logger.WithError(http.ListenAndServe(":8080", opsMux)).Fatal("metrics server failed")
+	}()
+
+	serveUntilSignalled(server, ready)
 }
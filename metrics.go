@@ -0,0 +1,146 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "admission_control"
+
+// admission decisions, the decision label of the request metrics
+const (
+	decisionAllowed = "allowed"
+	decisionDenied  = "denied"
+	// decisionError is a request that could not be evaluated, either a malformed review or an object that could not
+	// be decoded
+	decisionError = "error"
+)
+
+// unmonitoredPrefix is the namespace_prefix label of objects outside every monitored namespace prefix, the label is
+// limited to the configured prefixes to keep the number of series bounded.
+const unmonitoredPrefix = "unmonitored"
+
+var (
+	// the kind label of the request metrics is the kind of the object, as every endpoint dispatches by kind. It is
+	// empty for a review that could not be decoded.
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Admission requests by endpoint, object kind, decision and monitored namespace prefix.",
+	}, []string{"endpoint", "kind", "decision", "namespace_prefix"})
+
+	ruleViolationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rule_violations_total",
+		Help:      "Policy violations by endpoint, object kind, rule ID, rule mode and monitored namespace prefix.",
+	}, []string{"endpoint", "kind", "rule", "mode", "namespace_prefix"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to handle an admission request, by endpoint and object kind.",
+		// the apiserver gives up on a webhook after 10 seconds, most requests are handled in well under 10ms
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"endpoint", "kind"})
+
+	patchOperationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "patch_operations_total",
+		Help:      "JSON patch operations returned to the apiserver by endpoint and object kind.",
+	}, []string{"endpoint", "kind"})
+
+	// dryRunRequestsTotal counts server-side dry runs, they are not counted by requestsTotal, ruleViolationsTotal and
+	// patchOperationsTotal.
+	dryRunRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "dry_run_requests_total",
+		Help:      "Server-side dry run admission requests by endpoint, object kind, decision and monitored namespace prefix.",
+	}, []string{"endpoint", "kind", "decision", "namespace_prefix"})
+
+	// unknownKindRequestsTotal counts requests approved because no handler is registered for their kind, which means a
+	// webhook configuration sends kinds the webhook has no policy for.
+	unknownKindRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unknown_kind_requests_total",
+		Help:      "Admission requests approved because no handler is registered for their kind and subresource.",
+	}, []string{"group", "version", "kind", "subresource"})
+
+	configReloadsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reloads_total",
+		Help:      "Config changes detected, by result.",
+	}, []string{"result"})
+
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_successful",
+		Help:      "Whether the last config change was loaded (1) or rejected (0).",
+	})
+
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_success_timestamp_seconds",
+		Help:      "Unix time of the last successful config load.",
+	})
+
+	auditRecordsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_records_total",
+		Help:      "Audit records by result: written to the sink, failed to write or dropped because the buffer was full.",
+	}, []string{"result"})
+
+	// certExpiryTimestamp is the NotAfter time of the certificate currently served, alert on it approaching time().
+	certExpiryTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "tls_cert_expiry_timestamp_seconds",
+		Help:      "Unix time at which the served TLS certificate expires.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		ruleViolationsTotal,
+		requestDuration,
+		patchOperationsTotal,
+		dryRunRequestsTotal,
+		unknownKindRequestsTotal,
+		configReloadsTotal,
+		configLastReloadSuccessful,
+		configLastReloadSuccessTimestamp,
+		auditRecordsTotal,
+		certExpiryTimestamp,
+	)
+}
+
+// namespacePrefix returns the longest monitored namespace prefix the namespace starts with.
+func (c *Config) namespacePrefix(ns string) string {
+	prefix, ok := c.compiled().monitorNamespaces.longestPrefix(ns)
+	if !ok || prefix == "" {
+		return unmonitoredPrefix
+	}
+	return prefix
+}
+
+// observeConfigLoad records the result of loading the config files.
+func observeConfigLoad(err error) {
+	if err != nil {
+		configReloadsTotal.WithLabelValues("failure").Inc()
+		configLastReloadSuccessful.Set(0)
+		return
+	}
+	configReloadsTotal.WithLabelValues("success").Inc()
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+}
+
+// observeAdmission records the outcome of an admission request. Every violation is counted, including the ones whose
+// rule is only warned or audited.
+func observeAdmission(endpoint string, kind string, prefix string, decision string, violations []violation, patches int) {
+	requestsTotal.WithLabelValues(endpoint, kind, decision, prefix).Inc()
+	for _, v := range violations {
+		ruleViolationsTotal.WithLabelValues(endpoint, kind, v.Rule, v.Mode, prefix).Inc()
+	}
+	if patches > 0 {
+		patchOperationsTotal.WithLabelValues(endpoint, kind).Add(float64(patches))
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+// patchBuilder builds the JSON patch of a handler against the object of the request. It keeps a copy of the object
+// that every operation is applied to, so that it can tell which parents are missing and whether a field already
+// exists:
+//   - a field whose parents are missing is added together with them, as one add of the first missing parent
+//   - a field that exists is replaced, one that does not is added
+//   - a field inside a value the builder added is set in that value, instead of adding another operation
+//   - a field set twice is only patched once, with the last value, and setting a field drops the operations on fields
+//     inside it, which it overwrites
+type patchBuilder struct {
+	doc interface{}
+	ops []patchOperation
+}
+
+// newPatchBuilder returns a builder for the raw JSON object of a request.
+func newPatchBuilder(raw []byte) (*patchBuilder, error) {
+	doc, err := decodeGeneric(raw)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode object to patch: %v", err)
+	}
+	return &patchBuilder{doc: doc}, nil
+}
+
+// operations returns the patch built so far.
+func (b *patchBuilder) operations() []patchOperation {
+	return b.ops
+}
+
+// set patches the field at path to value, creating missing parents. The path is given as unescaped segments, such as
+// "metadata", "labels", "nginx.org/mergeable-ingress-type", an array element is given by its index or "-" to append.
+func (b *patchBuilder) set(value interface{}, path ...string) error {
+	if len(path) == 0 {
+		return errors.New("cannot patch the whole object")
+	}
+	generic, err := toGeneric(value)
+	if err != nil {
+		return fmt.Errorf("could not encode patch value for %v: %v", jsonPointer(path...), err)
+	}
+
+	// parent is the node holding node, it is nil while node is the object itself
+	var parent interface{}
+	node := b.doc
+	for i, segment := range path[:len(path)-1] {
+		child, ok, err := lookup(node, segment)
+		if err != nil {
+			return fmt.Errorf("cannot patch %v: %v", jsonPointer(path...), err)
+		}
+		if !ok || child == nil {
+			// add the first missing parent with the rest of the path in it
+			return b.put(node, path[:i+1], nest(path[i+1:], generic))
+		}
+		parent, node = node, child
+	}
+	if array, ok := node.([]interface{}); ok && path[len(path)-1] == "-" {
+		return b.appendTo(parent, array, path[:len(path)-1], generic)
+	}
+	return b.put(node, path, generic)
+}
+
+// put sets the last segment of path in parent, which is the node at the path without its last segment, and records the
+// operation.
+func (b *patchBuilder) put(parent interface{}, path []string, value interface{}) error {
+	pointer := jsonPointer(path...)
+	segment := path[len(path)-1]
+	op := "add"
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if existing, ok := p[segment]; ok && existing != nil {
+			op = "replace"
+		}
+		p[segment] = value
+	case []interface{}:
+		i, err := arrayIndex(p, segment)
+		if err != nil {
+			return fmt.Errorf("cannot patch %v: %v", pointer, err)
+		}
+		op = "replace"
+		p[i] = value
+	default:
+		return fmt.Errorf("cannot patch %v: parent is not an object or array", pointer)
+	}
+
+	if b.covered(pointer, value) {
+		return nil
+	}
+	// drop the operations inside the field, its new value overwrites them
+	kept := b.ops[:0]
+	for _, o := range b.ops {
+		if !strings.HasPrefix(o.Path, pointer+"/") {
+			kept = append(kept, o)
+		}
+	}
+	b.ops = append(kept, patchOperation{Op: op, Path: pointer, Value: value})
+	return nil
+}
+
+// appendTo appends value to the array at path, parent is the node holding the array.
+func (b *patchBuilder) appendTo(parent interface{}, array []interface{}, path []string, value interface{}) error {
+	// appending can move the array, it is stored in its parent again
+	appended := append(array, value)
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		p[path[len(path)-1]] = appended
+	case []interface{}:
+		i, _ := arrayIndex(p, path[len(path)-1])
+		p[i] = appended
+	default:
+		return fmt.Errorf("cannot patch %v: the object is not an array", jsonPointer(path...))
+	}
+	if b.covered(jsonPointer(path...), appended) {
+		return nil
+	}
+	b.ops = append(b.ops, patchOperation{Op: "add", Path: jsonPointer(append(path, "-")...), Value: value})
+	return nil
+}
+
+// covered reports whether the field at pointer is inside a value an operation already sets, in which case setting it in
+// the document has patched it, as the builder's values are shared with the document. An operation on the field itself
+// is given the new value.
+func (b *patchBuilder) covered(pointer string, value interface{}) bool {
+	for i := range b.ops {
+		if b.ops[i].Path == pointer {
+			b.ops[i].Value = value
+			return true
+		}
+		if strings.HasPrefix(pointer, b.ops[i].Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyPatch applies the patch to the object of the request and re-runs the rules of its handler on the result, so
+// that a handler can neither send a patch the apiserver cannot apply nor mutate an object into one the webhook would
+// deny. It returns an error if the patch does not apply or the patched object violates an enforced rule, the request
+// then fails closed.
+func verifyPatch(cfg *Config, req *admissionRequest, patchOps []patchOperation) error {
+	h := handlerFor(req.Kind, req.SubResource)
+	if h == nil || h.decode == nil {
+		return fmt.Errorf("internal error: cannot verify the patch of %v, no handler decodes it", req.Kind)
+	}
+	b, err := json.Marshal(patchOps)
+	if err != nil {
+		return fmt.Errorf("internal error: could not marshal JSON patch: %v", err)
+	}
+	patch, err := jsonpatch.DecodePatch(b)
+	if err != nil {
+		return fmt.Errorf("internal error: the webhook generated a malformed JSON patch: %v", err)
+	}
+	patched, err := patch.Apply(req.Object.Raw)
+	if err != nil {
+		return fmt.Errorf("internal error: the webhook generated a JSON patch that does not apply to the object: %v", err)
+	}
+
+	in, err := h.decode(patched)
+	if err != nil {
+		return fmt.Errorf("internal error: the patched object is invalid: %v", err)
+	}
+	in.Config, in.Namespace = cfg, req.Namespace
+	if req.Operation == operationUpdate && len(req.OldObject.Raw) > 0 {
+		if in.Old, err = h.decode(req.OldObject.Raw); err != nil {
+			return fmt.Errorf("internal error: %v", err)
+		}
+		in.Old.Config, in.Old.Namespace = cfg, req.Namespace
+	}
+	v := newViolations(h.rules, req.Name, req.Namespace)
+	evaluateRules(h.rules, in, v)
+	verr, ok := v.err().(*violationError)
+	if !ok {
+		return nil
+	}
+	// violations of rules that are warned or audited were accepted on the object as it was sent
+	var enforced []string
+	for _, violation := range verr.violations {
+		if cfg.ruleMode(req.Namespace, violation.Rule) == modeEnforce {
+			enforced = append(enforced, violation.String())
+		}
+	}
+	if len(enforced) == 0 {
+		return nil
+	}
+	return fmt.Errorf("internal error: the webhook's patch makes the object violate its own policy: %v", strings.Join(enforced, "; "))
+}
+
+// lookup returns the child of node named by segment, ok is false if node is an object without it.
+func lookup(node interface{}, segment string) (child interface{}, ok bool, err error) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok = n[segment]
+		return child, ok, nil
+	case []interface{}:
+		i, err := arrayIndex(n, segment)
+		if err != nil {
+			return nil, false, err
+		}
+		return n[i], true, nil
+	default:
+		return nil, false, fmt.Errorf("%v is not inside an object or array", segment)
+	}
+}
+
+// arrayIndex parses segment as an index of an existing element of the array.
+func arrayIndex(array []interface{}, segment string) (int, error) {
+	i, err := strconv.Atoi(segment)
+	if err != nil || i < 0 || i >= len(array) {
+		return 0, fmt.Errorf("%v is not an index of an array of length %d", segment, len(array))
+	}
+	return i, nil
+}
+
+// nest wraps value in one object per segment of path, so that it ends up at path. A "-" segment is an array holding the
+// value.
+func nest(path []string, value interface{}) interface{} {
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i] == "-" {
+			value = []interface{}{value}
+		} else {
+			value = map[string]interface{}{path[i]: value}
+		}
+	}
+	return value
+}
+
+// toGeneric converts a typed value to its JSON form of maps, slices and scalars, which the builder can walk.
+func toGeneric(value interface{}) (interface{}, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	return decodeGeneric(b)
+}
+
+// decodeGeneric decodes JSON to maps, slices and scalars, numbers are kept as json.Number so that large integers such as
+// resource versions are not rounded to a float64.
+func decodeGeneric(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var generic interface{}
+	err := d.Decode(&generic)
+	return generic, err
+}
+
+// pointerEscaper escapes a JSON pointer segment as required by RFC 6901.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// jsonPointer joins the segments to a JSON pointer.
+func jsonPointer(segments ...string) string {
+	var sb strings.Builder
+	for _, s := range segments {
+		sb.WriteByte('/')
+		sb.WriteString(pointerEscaper.Replace(s))
+	}
+	return sb.String()
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPatchBuilder(t *testing.T) {
+	type set struct {
+		value interface{}
+		path  []string
+	}
+	tests := []struct {
+		name string
+		doc  string
+		sets []set
+		want string
+	}{
+		{
+			name: "escaped keys",
+			doc:  `{"metadata":{"annotations":{"nginx.org/ssl-services":"a"}}}`,
+			sets: []set{
+				{"b", []string{"metadata", "annotations", "nginx.org/ssl-services"}},
+				{"c", []string{"metadata", "annotations", "a~b"}},
+			},
+			want: `[{"op":"replace","path":"/metadata/annotations/nginx.org~1ssl-services","value":"b"},
+				{"op":"add","path":"/metadata/annotations/a~0b","value":"c"}]`,
+		},
+		{
+			name: "missing parents are added with the field",
+			doc:  `{"metadata":{"name":"x"}}`,
+			sets: []set{{"x", []string{"metadata", "labels", "svc"}}},
+			want: `[{"op":"add","path":"/metadata/labels","value":{"svc":"x"}}]`,
+		},
+		{
+			name: "null parents are added with the field",
+			doc:  `{"metadata":{"labels":null}}`,
+			sets: []set{{"x", []string{"metadata", "labels", "svc"}}},
+			want: `[{"op":"add","path":"/metadata/labels","value":{"svc":"x"}}]`,
+		},
+		{
+			name: "fields inside an added parent are set in it",
+			doc:  `{"spec":{}}`,
+			sets: []set{
+				{true, []string{"spec", "securityContext", "runAsNonRoot"}},
+				{65534, []string{"spec", "securityContext", "runAsUser"}},
+			},
+			want: `[{"op":"add","path":"/spec/securityContext","value":{"runAsNonRoot":true,"runAsUser":65534}}]`,
+		},
+		{
+			name: "a field set twice is patched once with the last value",
+			doc:  `{"metadata":{"labels":{"svc":"a"}}}`,
+			sets: []set{
+				{"b", []string{"metadata", "labels", "svc"}},
+				{"c", []string{"metadata", "labels", "svc"}},
+			},
+			want: `[{"op":"replace","path":"/metadata/labels/svc","value":"c"}]`,
+		},
+		{
+			name: "setting a parent drops the operations inside it",
+			doc:  `{"metadata":{"labels":{"svc":"a"}}}`,
+			sets: []set{
+				{"b", []string{"metadata", "labels", "svc"}},
+				{"x", []string{"metadata", "labels", "app"}},
+				{map[string]string{"svc": "c"}, []string{"metadata", "labels"}},
+			},
+			want: `[{"op":"replace","path":"/metadata/labels","value":{"svc":"c"}}]`,
+		},
+		{
+			name: "array elements by index",
+			doc:  `{"spec":{"containers":[{"name":"a"},{"name":"b","resources":{}}]}}`,
+			sets: []set{{"100m", []string{"spec", "containers", "1", "resources", "requests", "cpu"}}},
+			want: `[{"op":"add","path":"/spec/containers/1/resources/requests","value":{"cpu":"100m"}}]`,
+		},
+		{
+			name: "append to an existing array",
+			doc:  `{"env":[{"name":"A"}]}`,
+			sets: []set{
+				{map[string]string{"name": "B"}, []string{"env", "-"}},
+				{map[string]string{"name": "C"}, []string{"env", "-"}},
+			},
+			want: `[{"op":"add","path":"/env/-","value":{"name":"B"}},{"op":"add","path":"/env/-","value":{"name":"C"}}]`,
+		},
+		{
+			name: "append to a missing array",
+			doc:  `{"containers":[{"name":"a"}]}`,
+			sets: []set{
+				{map[string]string{"name": "TZ"}, []string{"containers", "0", "env", "-"}},
+				{map[string]string{"name": "B"}, []string{"containers", "0", "env", "-"}},
+			},
+			want: `[{"op":"add","path":"/containers/0/env","value":[{"name":"TZ"},{"name":"B"}]}]`,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := newPatchBuilder([]byte(tc.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.sets {
+				if err := b.set(s.value, s.path...); err != nil {
+					t.Fatalf("set %v: %v", s.path, err)
+				}
+			}
+			got, err := json.Marshal(b.operations())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(t, got, []byte(tc.want)) {
+				t.Errorf("got patch %s, want %s", got, tc.want)
+			}
+
+			// the patch must turn the object into the builder's copy of it
+			patch, err := jsonpatch.DecodePatch(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := patch.Apply([]byte(tc.doc))
+			if err != nil {
+				t.Fatalf("patch does not apply: %v", err)
+			}
+			doc, err := json.Marshal(b.doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(t, patched, doc) {
+				t.Errorf("patched object is %s, want %s", patched, doc)
+			}
+		})
+	}
+}
+
+func TestPatchBuilderKeepsLargeIntegers(t *testing.T) {
+	b, err := newPatchBuilder([]byte(`{"metadata":{"generation":9007199254740993}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.set(map[string]int64{"n": 9007199254740995}, "metadata", "labels"); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := json.Marshal(b.doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"metadata":{"generation":9007199254740993,"labels":{"n":9007199254740995}}}`; string(doc) != want {
+		t.Errorf("got %s, want %s", doc, want)
+	}
+}
+
+func TestPatchBuilderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		path []string
+	}{
+		{"whole object", `{}`, nil},
+		{"index out of range", `{"containers":[{"name":"a"}]}`, []string{"containers", "1", "image"}},
+		{"index not a number", `{"containers":[{"name":"a"}]}`, []string{"containers", "a", "image"}},
+		{"parent is a scalar", `{"metadata":{"name":"x"}}`, []string{"metadata", "name", "svc"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := newPatchBuilder([]byte(tc.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := b.set("x", tc.path...); err == nil {
+				t.Errorf("set %v succeeded with patch %v, want an error", tc.path, b.operations())
+			}
+		})
+	}
+}
+
+func TestJSONPointer(t *testing.T) {
+	tests := []struct {
+		segments []string
+		want     string
+	}{
+		{nil, ""},
+		{[]string{"metadata", "labels"}, "/metadata/labels"},
+		{[]string{"annotations", "nginx.org/ssl-services"}, "/annotations/nginx.org~1ssl-services"},
+		{[]string{"a~/b"}, "/a~0~1b"},
+		{[]string{""}, "/"},
+	}
+	for _, tc := range tests {
+		if got := jsonPointer(tc.segments...); got != tc.want {
+			t.Errorf("jsonPointer(%q) = %q, want %q", tc.segments, got, tc.want)
+		}
+	}
+}
+
+// jsonEqual reports whether a and b hold the same JSON value.
+func jsonEqual(t *testing.T, a []byte, b []byte) bool {
+	t.Helper()
+	var va, vb interface{}
+	if err := json.Unmarshal(a, &va); err != nil {
+		t.Fatalf("invalid JSON %s: %v", a, err)
+	}
+	if err := json.Unmarshal(b, &vb); err != nil {
+		t.Fatalf("invalid JSON %s: %v", b, err)
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+func TestVerifyPatch(t *testing.T) {
+	const deployment = `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"api","namespace":"tools-dev",
+		"labels":{"svc":"api"},"annotations":{"description":"api"}},"spec":{"selector":{"matchLabels":{"svc":"api"}},
+		"template":{"metadata":{"labels":{"svc":"api"}},"spec":{"containers":[{"name":"app","image":"alpine:3.12"}]}}}}`
+	deploymentKind := metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"}
+	tests := []struct {
+		name  string
+		kind  metav1.GroupVersionKind
+		patch []patchOperation
+		modes map[string]string
+		// wantErr is part of the error the request fails closed with, empty if the patch is returned
+		wantErr string
+	}{
+		{
+			name:  "compliant patch",
+			kind:  deploymentKind,
+			patch: []patchOperation{{Op: "add", Path: "/spec/template/spec/containers/0/env", Value: []map[string]string{{"name": "TZ", "value": "UTC"}}}},
+		},
+		{
+			name:    "patch that does not apply",
+			kind:    deploymentKind,
+			patch:   []patchOperation{{Op: "replace", Path: "/spec/template/spec/volumes/0/name", Value: "x"}},
+			wantErr: "does not apply to the object",
+		},
+		{
+			name:    "patch that violates an enforced rule",
+			kind:    deploymentKind,
+			patch:   []patchOperation{{Op: "remove", Path: "/metadata/labels/svc"}},
+			wantErr: ruleDeploySvcLabel,
+		},
+		{
+			name:  "patch that violates a warned rule",
+			kind:  deploymentKind,
+			patch: []patchOperation{{Op: "replace", Path: "/spec/template/spec/containers/0/image", Value: "alpine:latest"}},
+			modes: map[string]string{ruleDeployImageTag: modeWarn},
+		},
+		{
+			name:    "kind without a handler",
+			kind:    metav1.GroupVersionKind{Version: "v1", Kind: "ConfigMap"},
+			patch:   []patchOperation{{Op: "add", Path: "/metadata/labels", Value: map[string]string{"svc": "api"}}},
+			wantErr: "no handler decodes it",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{MonitorNamespaces: []string{"tools-"}, Rules: RulesConfig{Modes: tt.modes}}
+			req := &admissionRequest{UID: "test", Kind: tt.kind, Name: "api", Namespace: "tools-dev", Operation: operationCreate}
+			req.Object.Raw = []byte(deployment)
+			req.log = requestLogger(admitPath, req)
+			// the admitFunc returns the patch under test, the request must fail closed without a patch if it is bad
+			v := evaluateRequest(cfg, func(*Config, *admissionRequest) ([]patchOperation, error) {
+				return tt.patch, nil
+			}, req)
+			if tt.wantErr == "" {
+				if v.decision != decisionAllowed || len(v.patchOps) != len(tt.patch) {
+					t.Errorf("got decision %v with patch %v, want the patch allowed: %v", v.decision, v.patchOps, v.err)
+				}
+				return
+			}
+			if v.decision != decisionError || v.err == nil || !strings.Contains(v.err.Error(), tt.wantErr) {
+				t.Errorf("got decision %v: %v, want error %v", v.decision, v.err, tt.wantErr)
+			}
+			if len(v.patchOps) > 0 {
+				t.Errorf("got patch %v, want none", v.patchOps)
+			}
+		})
+	}
+}
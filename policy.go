@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// policy is the compiled form of a Config. It is built once when the config is loaded, so that admitting an object
+// never compiles a regex or scans a list: regexes are precompiled, exemptions and valid hosts are sets and namespace
+// prefixes are looked up in a trie.
+type policy struct {
+	nginxMasterAllow          map[string]*regexp.Regexp
+	nginxMinionAllow          map[string]*regexp.Regexp
+	minionRequiredAnnotations map[string]*regexp.Regexp
+	minionRequiredLabels      map[string]*regexp.Regexp
+
+	redactAnnotations []*regexp.Regexp
+	redactLabels      []*regexp.Regexp
+	redactEnv         []*regexp.Regexp
+
+	// the exemption sets are keyed by namespace/name
+	exemptIngresses   map[string]bool
+	exemptDeployments map[string]bool
+	exemptServices    map[string]bool
+	validHosts        map[string]bool
+
+	monitorNamespaces *prefixTrie
+	// ruleNamespaces holds the namespace prefixes of rules.namespaces
+	ruleNamespaces *prefixTrie
+
+	// resources is the default resource policy, namespaceResources are keyed by the prefixes in resourceNamespaces
+	resources          *resourcePolicy
+	namespaceResources map[string]*resourcePolicy
+	resourceNamespaces *prefixTrie
+}
+
+// matchEverything replaces a redaction regex that does not compile, so that a typo in the config masks too much rather
+// than leaking a secret.
+var matchEverything = regexp.MustCompile("")
+
+// newPolicy compiles the config. It returns a problem for every regex that does not compile and for every invalid
+// resource policy setting, an allow or required regex that does not compile is kept as nil and never matches.
+func newPolicy(cfg *Config) (*policy, []string) {
+	var problems []string
+	compileMap := func(name string, entries map[string]string) map[string]*regexp.Regexp {
+		compiled := make(map[string]*regexp.Regexp, len(entries))
+		for _, k := range sortedKeys(entries) {
+			re, err := regexp.Compile(entries[k])
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v[%v]: %v", name, k, err))
+			}
+			compiled[k] = re
+		}
+		return compiled
+	}
+	compileList := func(name string, patterns []string) []*regexp.Regexp {
+		compiled := make([]*regexp.Regexp, 0, len(patterns))
+		for i, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v[%d]: %v", name, i, err))
+				re = matchEverything
+			}
+			compiled = append(compiled, re)
+		}
+		return compiled
+	}
+	set := func(entries []string) map[string]bool {
+		s := make(map[string]bool, len(entries))
+		for _, e := range entries {
+			s[e] = true
+		}
+		return s
+	}
+
+	p := &policy{
+		nginxMasterAllow:          compileMap("nginxMasterIngressAllow", cfg.NginxMasterIngressAllow),
+		nginxMinionAllow:          compileMap("nginxMinionIngressAllow", cfg.NginxMinionIngressAllow),
+		minionRequiredAnnotations: compileMap("ingressMinionRequiredAnnotations", cfg.IngressMinionRequiredAnnotations),
+		minionRequiredLabels:      compileMap("ingressMinionRequiredLabels", cfg.IngressMinionRequiredLabels),
+		redactAnnotations:         compileList("logging.redactAnnotations", cfg.Logging.RedactAnnotations),
+		redactLabels:              compileList("logging.redactLabels", cfg.Logging.RedactLabels),
+		redactEnv:                 compileList("logging.redactEnv", cfg.Logging.RedactEnv),
+		exemptIngresses:           set(cfg.ExemptIngresses),
+		exemptDeployments:         set(cfg.ExemptDeployments),
+		exemptServices:            set(cfg.ExemptServices),
+		validHosts:                set(cfg.ValidHosts),
+		monitorNamespaces:         newPrefixTrie(),
+		ruleNamespaces:            newPrefixTrie(),
+		namespaceResources:        make(map[string]*resourcePolicy, len(cfg.Resources.Namespaces)),
+		resourceNamespaces:        newPrefixTrie(),
+	}
+	for _, prefix := range cfg.MonitorNamespaces {
+		p.monitorNamespaces.insert(prefix)
+	}
+	for prefix := range cfg.Rules.Namespaces {
+		p.ruleNamespaces.insert(prefix)
+	}
+
+	var resourceProblems []string
+	p.resources, resourceProblems = newResourcePolicy("resources.default", cfg.Resources.Default)
+	problems = append(problems, resourceProblems...)
+	prefixes := make([]string, 0, len(cfg.Resources.Namespaces))
+	for prefix := range cfg.Resources.Namespaces {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		where := fmt.Sprintf("resources.namespaces[%v]", prefix)
+		p.namespaceResources[prefix], resourceProblems = newResourcePolicy(where, cfg.Resources.Namespaces[prefix])
+		problems = append(problems, resourceProblems...)
+		p.resourceNamespaces.insert(prefix)
+	}
+	return p, problems
+}
+
+// compiled returns the compiled policy of the config. A loaded config is compiled by readConfig, a Config built by
+// hand is compiled on every call.
+func (c *Config) compiled() *policy {
+	if c.policy != nil {
+		return c.policy
+	}
+	p, _ := newPolicy(c)
+	return p
+}
+
+// prefixTrie finds the longest of a set of prefixes that a string starts with.
+type prefixTrie struct {
+	children map[byte]*prefixTrie
+	// prefix is set on the node that ends an inserted prefix
+	prefix   string
+	terminal bool
+}
+
+func newPrefixTrie() *prefixTrie {
+	return &prefixTrie{children: map[byte]*prefixTrie{}}
+}
+
+func (t *prefixTrie) insert(prefix string) {
+	n := t
+	for i := 0; i < len(prefix); i++ {
+		child, ok := n.children[prefix[i]]
+		if !ok {
+			child = newPrefixTrie()
+			n.children[prefix[i]] = child
+		}
+		n = child
+	}
+	n.prefix = prefix
+	n.terminal = true
+}
+
+// longestPrefix returns the longest inserted prefix s starts with, ok is false if there is none.
+func (t *prefixTrie) longestPrefix(s string) (prefix string, ok bool) {
+	n := t
+	if n.terminal {
+		prefix, ok = n.prefix, true
+	}
+	for i := 0; i < len(s); i++ {
+		if n = n.children[s[i]]; n == nil {
+			break
+		}
+		if n.terminal {
+			prefix, ok = n.prefix, true
+		}
+	}
+	return prefix, ok
+}
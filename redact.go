@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+)
+
+// LoggingConfig controls what is written to the log. Level is a logrus level name and Format is json or text. The
+// Redact lists are regexes, a value is masked when its key or env var name matches any of them.
+type LoggingConfig struct {
+	Level  string
+	Format string
+	// LogObjects switches on logging of the full object and patch of every request, with sensitive values masked
+	LogObjects        bool
+	RedactAnnotations []string
+	RedactLabels      []string
+	RedactEnv         []string
+}
+
+const (
+	// redactedValue replaces every masked value
+	redactedValue = "[REDACTED]"
+	// lastAppliedAnnotation holds a complete copy of the object as applied by kubectl, it is redacted like the object
+	lastAppliedAnnotation = "kubectl.kubernetes.io/last-applied-configuration"
+)
+
+// redactObject returns the JSON object with sensitive values masked: annotations and labels with a matching key, env
+// vars with a matching name, and the data of Secret objects. Nested objects such as pod templates are redacted too.
+func (c *Config) redactObject(raw []byte) ([]byte, error) {
+	var obj interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	c.redact(obj)
+	return json.Marshal(obj)
+}
+
+// redact masks sensitive values in a decoded JSON value in place.
+func (c *Config) redact(v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if t["kind"] == "Secret" {
+			for _, field := range []string{"data", "stringData"} {
+				if data, ok := t[field].(map[string]interface{}); ok {
+					for k := range data {
+						data[k] = redactedValue
+					}
+				}
+			}
+		}
+		for k, child := range t {
+			switch k {
+			case "metadata":
+				if meta, ok := child.(map[string]interface{}); ok {
+					c.redactMetadata(meta)
+				}
+			case "env":
+				if env, ok := child.([]interface{}); ok {
+					c.redactEnv(env)
+				}
+			}
+			c.redact(child)
+		}
+	case []interface{}:
+		for _, child := range t {
+			c.redact(child)
+		}
+	}
+}
+
+// redactMetadata masks matching annotation and label values of an object's metadata.
+func (c *Config) redactMetadata(meta map[string]interface{}) {
+	if annotations, ok := meta["annotations"].(map[string]interface{}); ok {
+		for k, v := range annotations {
+			s, _ := v.(string)
+			if k == lastAppliedAnnotation {
+				annotations[k] = c.redactLastApplied(s)
+			} else {
+				annotations[k] = c.redactAnnotation(k, s)
+			}
+		}
+	}
+	if labels, ok := meta["labels"].(map[string]interface{}); ok {
+		for k, v := range labels {
+			s, _ := v.(string)
+			labels[k] = c.redactLabel(k, s)
+		}
+	}
+}
+
+// redactLastApplied redacts the object copy kubectl keeps in the last-applied-configuration annotation, it is masked
+// entirely if it cannot be parsed.
+func (c *Config) redactLastApplied(value string) string {
+	redacted, err := c.redactObject([]byte(value))
+	if err != nil {
+		return redactedValue
+	}
+	return string(redacted)
+}
+
+// redactEnv masks the value of every env var with a matching name, values taken from a secretKeyRef are only a
+// reference and are kept.
+func (c *Config) redactEnv(env []interface{}) {
+	for _, e := range env {
+		envVar, ok := e.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := envVar["name"].(string)
+		if _, hasValue := envVar["value"]; hasValue && matchesAny(c.compiled().redactEnv, name) {
+			envVar["value"] = redactedValue
+		}
+	}
+}
+
+// redactAnnotation returns the annotation value, or redactedValue if the key is configured as sensitive.
+func (c *Config) redactAnnotation(key string, value string) string {
+	if matchesAny(c.compiled().redactAnnotations, key) {
+		return redactedValue
+	}
+	return value
+}
+
+// redactLabel returns the label value, or redactedValue if the key is configured as sensitive.
+func (c *Config) redactLabel(key string, value string) string {
+	if matchesAny(c.compiled().redactLabels, key) {
+		return redactedValue
+	}
+	return value
+}
+
+// matchesAny reports whether s matches any of the regexes.
+func matchesAny(regexes []*regexp.Regexp, s string) bool {
+	for _, re := range regexes {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
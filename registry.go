@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// admitPath is the webhook path every kind is admitted on, the request is dispatched to the handler registered for its
+// kind, see admitByKind.
+const admitPath = "/admit"
+
+// admitHandler is the handler admitting one kind, together with the resource it is registered for in the
+// MutatingWebhookConfiguration and a sample object, which the readiness self-check and the benchmarks evaluate.
+// decode decodes an object of the kind for its rules, it is used to re-validate the object once patched, see
+// verifyPatch.
+type admitHandler struct {
+	kind metav1.GroupVersionKind
+	// subResource is empty for the object itself
+	subResource string
+	resource    metav1.GroupVersionResource
+	admit       admitFunc
+	// rules is the resource name the handler's rules are registered for, see evaluateRules
+	rules  string
+	decode func(raw []byte) (*ruleInput, error)
+	sample string
+	// alias is the path that admitted only this kind before admitPath, it is still served for existing webhook
+	// configurations and dispatches by kind like admitPath
+	alias string
+}
+
+// handlerKey identifies the requests a handler admits.
+type handlerKey struct {
+	kind        metav1.GroupVersionKind
+	subResource string
+}
+
+// String names the kind and subresource the handler admits.
+func (h *admitHandler) String() string {
+	if h.subResource == "" {
+		return h.kind.String()
+	}
+	return fmt.Sprintf("%v, SubResource=%v", h.kind, h.subResource)
+}
+
+// admitHandlers holds every handler in registration order, handlerRegistry indexes them by kind and subresource.
+var (
+	admitHandlers   []*admitHandler
+	handlerRegistry = map[handlerKey]*admitHandler{}
+)
+
+// registerHandlers adds handlers to the registry, it is called from the init function of each handler.
+func registerHandlers(handlers ...*admitHandler) {
+	for _, h := range handlers {
+		key := handlerKey{kind: h.kind, subResource: h.subResource}
+		if handlerRegistry[key] != nil {
+			panic(fmt.Sprintf("a handler for %v is registered twice", h))
+		}
+		handlerRegistry[key] = h
+		admitHandlers = append(admitHandlers, h)
+	}
+}
+
+// handlerFor returns the handler registered for the kind and subresource, or nil if there is none.
+func handlerFor(kind metav1.GroupVersionKind, subResource string) *admitHandler {
+	return handlerRegistry[handlerKey{kind: kind, subResource: subResource}]
+}
+
+// admitByKind dispatches the request to the handler registered for its kind and subresource. A request for a kind
+// without a handler is approved, as the webhook has no policy for it, but it is counted and logged, as it means a
+// webhook configuration sends kinds the webhook does not know.
+func admitByKind(cfg *Config, req *admissionRequest) ([]patchOperation, error) {
+	h := handlerFor(req.Kind, req.SubResource)
+	if h == nil {
+		unknownKindRequestsTotal.WithLabelValues(req.Kind.Group, req.Kind.Version, req.Kind.Kind, req.SubResource).Inc()
+		req.log.WithFields(logrus.Fields{"resource": req.Resource.String(), "subresource": req.SubResource}).
+			Warn("Approved, no handler is registered for the kind")
+		return nil, nil
+	}
+	if req.Operation == operationUpdate && isBeingDeleted(req.Object.Raw) {
+		// the update removes a finalizer or otherwise completes a deletion, rejecting it would leave the object stuck
+		req.log.Info("Approved, object is being deleted")
+		return nil, nil
+	}
+	return h.admit(cfg, req)
+}
+
+// isBeingDeleted reports whether the object has metadata.deletionTimestamp set.
+func isBeingDeleted(raw []byte) bool {
+	var obj metav1.PartialObjectMetadata
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		// the handler reports the object as malformed
+		return false
+	}
+	return obj.DeletionTimestamp != nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// resource policy modes
+const (
+	// resourceModeDefault only sets the requests and limits a container does not set
+	resourceModeDefault = "default"
+	// resourceModeClamp also moves requests and limits into their bounds and lowers limits to the ratio cap
+	resourceModeClamp = "clamp"
+	// resourceModeReject also reports requests and limits out of their bounds as violations of DEPLOY-RESOURCES
+	resourceModeReject = "reject"
+)
+
+// ResourcesConfig selects the resource policy of containers. Default applies to every namespace without a more specific
+// policy, Namespaces holds the policies of namespaces starting with a given prefix, the longest matching prefix wins. A
+// namespace policy replaces the default policy as a whole.
+type ResourcesConfig struct {
+	Default    ResourcePolicyConfig
+	Namespaces map[string]ResourcePolicyConfig
+}
+
+// ResourcePolicyConfig is the policy for container requests and limits. The maps are keyed by resource name, such as cpu
+// or memory, and hold quantities, such as 100m or 64Mi. Mode is default, clamp or reject, empty is default.
+// RequireLimits are the resources every container must have a limit for, after defaulting, in every mode.
+// MaxLimitRequestRatio caps the limit of a resource at this multiple of its request.
+type ResourcePolicyConfig struct {
+	Mode                 string
+	DefaultRequests      map[string]string
+	DefaultLimits        map[string]string
+	MinRequests          map[string]string
+	MaxRequests          map[string]string
+	MinLimits            map[string]string
+	MaxLimits            map[string]string
+	RequireLimits        []string
+	MaxLimitRequestRatio map[string]float64
+}
+
+// resourcePolicy is the compiled form of a ResourcePolicyConfig.
+type resourcePolicy struct {
+	mode            string
+	defaultRequests v1.ResourceList
+	defaultLimits   v1.ResourceList
+	minRequests     v1.ResourceList
+	maxRequests     v1.ResourceList
+	minLimits       v1.ResourceList
+	maxLimits       v1.ResourceList
+	requireLimits   []v1.ResourceName
+	maxRatio        map[v1.ResourceName]float64
+}
+
+// resourceProblem is one way the resources of a container break the policy, field is relative to the container.
+type resourceProblem struct {
+	field   string
+	missing bool
+	message string
+}
+
+// newResourcePolicy compiles the policy found at where in the config, it returns a problem for every mode, quantity
+// and ratio that is invalid and every default outside its bounds. Invalid quantities are left out of the policy.
+func newResourcePolicy(where string, c ResourcePolicyConfig) (*resourcePolicy, []string) {
+	var problems []string
+	quantities := func(name string, entries map[string]string) v1.ResourceList {
+		list := make(v1.ResourceList, len(entries))
+		for _, k := range sortedKeys(entries) {
+			q, err := resource.ParseQuantity(entries[k])
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%v.%v[%v]: %v", where, name, k, err))
+				continue
+			}
+			list[v1.ResourceName(k)] = q
+		}
+		return list
+	}
+
+	p := &resourcePolicy{
+		mode:            c.Mode,
+		defaultRequests: quantities("defaultRequests", c.DefaultRequests),
+		defaultLimits:   quantities("defaultLimits", c.DefaultLimits),
+		minRequests:     quantities("minRequests", c.MinRequests),
+		maxRequests:     quantities("maxRequests", c.MaxRequests),
+		minLimits:       quantities("minLimits", c.MinLimits),
+		maxLimits:       quantities("maxLimits", c.MaxLimits),
+		maxRatio:        make(map[v1.ResourceName]float64, len(c.MaxLimitRequestRatio)),
+	}
+	switch c.Mode {
+	case "":
+		p.mode = resourceModeDefault
+	case resourceModeDefault, resourceModeClamp, resourceModeReject:
+	default:
+		problems = append(problems, fmt.Sprintf("%v.mode: unknown mode %v, use %v, %v or %v", where, c.Mode, resourceModeDefault, resourceModeClamp, resourceModeReject))
+		// fail safe, an unknown mode must never weaken the policy
+		p.mode = resourceModeReject
+	}
+	for _, name := range c.RequireLimits {
+		p.requireLimits = append(p.requireLimits, v1.ResourceName(name))
+	}
+	ratioNames := make([]string, 0, len(c.MaxLimitRequestRatio))
+	for name := range c.MaxLimitRequestRatio {
+		ratioNames = append(ratioNames, name)
+	}
+	sort.Strings(ratioNames)
+	for _, name := range ratioNames {
+		ratio := c.MaxLimitRequestRatio[name]
+		if ratio < 1 {
+			problems = append(problems, fmt.Sprintf("%v.maxLimitRequestRatio[%v]: %v is below 1, a limit cannot be lower than its request", where, name, ratio))
+			continue
+		}
+		p.maxRatio[v1.ResourceName(name)] = ratio
+	}
+	for _, bounds := range []struct {
+		name               string
+		min, max, defaults v1.ResourceList
+	}{{"Requests", p.minRequests, p.maxRequests, p.defaultRequests}, {"Limits", p.minLimits, p.maxLimits, p.defaultLimits}} {
+		for _, name := range sortedResourceNames(bounds.min) {
+			min := bounds.min[name]
+			if max, ok := bounds.max[name]; ok && min.Cmp(max) > 0 {
+				problems = append(problems, fmt.Sprintf("%v.min%v[%v]: %v is above max%v[%v]: %v", where, bounds.name, name, min.String(), bounds.name, name, max.String()))
+			}
+		}
+		// a default out of bounds would be rejected, or clamped, as soon as it is applied
+		for _, name := range sortedResourceNames(bounds.defaults) {
+			q := bounds.defaults[name]
+			if min, ok := bounds.min[name]; ok && q.Cmp(min) < 0 {
+				problems = append(problems, fmt.Sprintf("%v.default%v[%v]: %v is below min%v[%v]: %v", where, bounds.name, name, q.String(), bounds.name, name, min.String()))
+			} else if max, ok := bounds.max[name]; ok && q.Cmp(max) > 0 {
+				problems = append(problems, fmt.Sprintf("%v.default%v[%v]: %v is above max%v[%v]: %v", where, bounds.name, name, q.String(), bounds.name, name, max.String()))
+			}
+		}
+	}
+	return p, problems
+}
+
+// resourcePolicy returns the resource policy of the namespace.
+func (c *Config) resourcePolicy(ns string) *resourcePolicy {
+	p := c.compiled()
+	if prefix, ok := p.resourceNamespaces.longestPrefix(ns); ok {
+		return p.namespaceResources[prefix]
+	}
+	return p.resources
+}
+
+// resolve returns the requirements the container should have under the policy, and the problems it has that the policy
+// does not fix. Missing requests and limits are defaulted in every mode, bounds and ratios are applied in clamp mode
+// and reported in reject mode.
+func (p *resourcePolicy) resolve(r v1.ResourceRequirements) (v1.ResourceRequirements, []resourceProblem) {
+	want := v1.ResourceRequirements{Requests: v1.ResourceList{}, Limits: v1.ResourceList{}}
+	for name, q := range r.Requests {
+		want.Requests[name] = q.DeepCopy()
+	}
+	for name, q := range r.Limits {
+		want.Limits[name] = q.DeepCopy()
+	}
+
+	// a default never makes a request larger than the limit, or a limit smaller than the request
+	for _, name := range sortedResourceNames(p.defaultRequests) {
+		if _, ok := want.Requests[name]; !ok {
+			want.Requests[name] = minQuantity(p.defaultRequests[name], want.Limits, name)
+		}
+	}
+	for _, name := range sortedResourceNames(p.defaultLimits) {
+		if _, ok := want.Limits[name]; !ok {
+			want.Limits[name] = maxQuantity(p.defaultLimits[name], want.Requests, name)
+			// a default limit is kept within the ratio cap, it must not get a container rejected
+			if capped, ok := p.ratioCap(want, name); ok {
+				want.Limits[name] = capped
+			}
+		}
+	}
+
+	var problems []resourceProblem
+	for _, name := range p.requireLimits {
+		if _, ok := want.Limits[name]; !ok {
+			problems = append(problems, resourceProblem{field: "resources.limits." + string(name), missing: true,
+				message: fmt.Sprintf("resources.limits.%v is required", name)})
+		}
+	}
+
+	switch p.mode {
+	case resourceModeClamp:
+		clamp(want.Requests, p.minRequests, p.maxRequests)
+		clamp(want.Limits, p.minLimits, p.maxLimits)
+		for _, name := range sortedResourceNames(want.Limits) {
+			if capped, ok := p.ratioCap(want, name); ok {
+				want.Limits[name] = capped
+			}
+			// clamping must not leave a request above its limit, which the apiserver rejects. The limit is raised to
+			// the request unless that passes its maximum, only then the request is lowered below its minimum
+			if request, limit := want.Requests[name], want.Limits[name]; request.Cmp(limit) > 0 {
+				if max, ok := p.maxLimits[name]; !ok || request.Cmp(max) <= 0 {
+					want.Limits[name] = request.DeepCopy()
+				} else {
+					want.Requests[name] = limit.DeepCopy()
+				}
+			}
+		}
+	case resourceModeReject:
+		problems = append(problems, outOfBounds("requests", want.Requests, p.minRequests, p.maxRequests)...)
+		problems = append(problems, outOfBounds("limits", want.Limits, p.minLimits, p.maxLimits)...)
+		for _, name := range sortedResourceNames(want.Limits) {
+			if capped, ok := p.ratioCap(want, name); ok {
+				limit, request := want.Limits[name], want.Requests[name]
+				problems = append(problems, resourceProblem{field: "resources.limits." + string(name),
+					message: fmt.Sprintf("resources.limits.%v: %v is more than %v times the request %v, at most %v is allowed",
+						name, limit.String(), p.maxRatio[name], request.String(), capped.String())})
+			}
+		}
+	}
+	return want, problems
+}
+
+// ratioCap returns the highest limit of the resource the ratio cap allows, ok is false if the limit is within it.
+func (p *resourcePolicy) ratioCap(r v1.ResourceRequirements, name v1.ResourceName) (resource.Quantity, bool) {
+	ratio, hasRatio := p.maxRatio[name]
+	request, hasRequest := r.Requests[name]
+	limit := r.Limits[name]
+	if !hasRatio || !hasRequest {
+		return resource.Quantity{}, false
+	}
+	capped := resource.NewMilliQuantity(int64(float64(request.MilliValue())*ratio), request.Format)
+	if limit.Cmp(*capped) <= 0 {
+		return resource.Quantity{}, false
+	}
+	return *capped, true
+}
+
+// clamp moves every quantity of list into its bounds.
+func clamp(list v1.ResourceList, min v1.ResourceList, max v1.ResourceList) {
+	for name, q := range list {
+		if lower, ok := min[name]; ok && q.Cmp(lower) < 0 {
+			list[name] = lower.DeepCopy()
+		} else if upper, ok := max[name]; ok && q.Cmp(upper) > 0 {
+			list[name] = upper.DeepCopy()
+		}
+	}
+}
+
+// outOfBounds returns a problem for every quantity of list outside its bounds, kind is requests or limits.
+func outOfBounds(kind string, list v1.ResourceList, min v1.ResourceList, max v1.ResourceList) []resourceProblem {
+	var problems []resourceProblem
+	for _, name := range sortedResourceNames(list) {
+		q := list[name]
+		field := fmt.Sprintf("resources.%v.%v", kind, name)
+		if lower, ok := min[name]; ok && q.Cmp(lower) < 0 {
+			problems = append(problems, resourceProblem{field: field, message: fmt.Sprintf("%v: %v is below the minimum %v", field, q.String(), lower.String())})
+		} else if upper, ok := max[name]; ok && q.Cmp(upper) > 0 {
+			problems = append(problems, resourceProblem{field: field, message: fmt.Sprintf("%v: %v is above the maximum %v", field, q.String(), upper.String())})
+		}
+	}
+	return problems
+}
+
+// minQuantity returns q, or the quantity of the resource in list if that is smaller.
+func minQuantity(q resource.Quantity, list v1.ResourceList, name v1.ResourceName) resource.Quantity {
+	if other, ok := list[name]; ok && other.Cmp(q) < 0 {
+		return other.DeepCopy()
+	}
+	return q.DeepCopy()
+}
+
+// maxQuantity returns q, or the quantity of the resource in list if that is larger.
+func maxQuantity(q resource.Quantity, list v1.ResourceList, name v1.ResourceName) resource.Quantity {
+	if other, ok := list[name]; ok && other.Cmp(q) > 0 {
+		return other.DeepCopy()
+	}
+	return q.DeepCopy()
+}
+
+// sortedResourceNames returns the resource names of list in sorted order, so that patches and violations are stable.
+func sortedResourceNames(list v1.ResourceList) []v1.ResourceName {
+	names := make([]v1.ResourceName, 0, len(list))
+	for name := range list {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+	return names
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// quantities is a resource list written as strings, such as {"cpu": "100m"}.
+type quantities map[string]string
+
+func (q quantities) list() v1.ResourceList {
+	if q == nil {
+		return nil
+	}
+	list := v1.ResourceList{}
+	for name, value := range q {
+		list[v1.ResourceName(name)] = resource.MustParse(value)
+	}
+	return list
+}
+
+func quantitiesOf(list v1.ResourceList) quantities {
+	q := quantities{}
+	for name, value := range list {
+		q[string(name)] = value.String()
+	}
+	return q
+}
+
+func TestResourcePolicyResolve(t *testing.T) {
+	tests := []struct {
+		name                     string
+		policy                   ResourcePolicyConfig
+		requests, limits         quantities
+		wantRequests, wantLimits quantities
+		// wantProblems are the fields of the problems, missing ones are prefixed with missing:
+		wantProblems []string
+	}{
+		{
+			name:         "default mode sets only what is missing",
+			policy:       ResourcePolicyConfig{DefaultRequests: quantities{"cpu": "100m", "memory": "64Mi"}, DefaultLimits: quantities{"memory": "128Mi"}},
+			requests:     quantities{"cpu": "2"},
+			wantRequests: quantities{"cpu": "2", "memory": "64Mi"},
+			wantLimits:   quantities{"memory": "128Mi"},
+		},
+		{
+			name:         "default mode leaves bounds alone",
+			policy:       ResourcePolicyConfig{MaxRequests: quantities{"cpu": "1"}, MaxLimitRequestRatio: map[string]float64{"cpu": 2}},
+			requests:     quantities{"cpu": "2"},
+			limits:       quantities{"cpu": "8"},
+			wantRequests: quantities{"cpu": "2"},
+			wantLimits:   quantities{"cpu": "8"},
+		},
+		{
+			name:         "a default request is not above the limit",
+			policy:       ResourcePolicyConfig{DefaultRequests: quantities{"cpu": "500m"}},
+			limits:       quantities{"cpu": "200m"},
+			wantRequests: quantities{"cpu": "200m"},
+			wantLimits:   quantities{"cpu": "200m"},
+		},
+		{
+			name:         "a default limit is not below the request",
+			policy:       ResourcePolicyConfig{DefaultLimits: quantities{"memory": "128Mi"}},
+			requests:     quantities{"memory": "256Mi"},
+			wantRequests: quantities{"memory": "256Mi"},
+			wantLimits:   quantities{"memory": "256Mi"},
+		},
+		{
+			name:         "required limits are reported in every mode",
+			policy:       ResourcePolicyConfig{RequireLimits: []string{"memory"}},
+			requests:     quantities{"memory": "64Mi"},
+			wantRequests: quantities{"memory": "64Mi"},
+			wantLimits:   quantities{},
+			wantProblems: []string{"missing:resources.limits.memory"},
+		},
+		{
+			name: "clamp moves requests and limits into their bounds",
+			policy: ResourcePolicyConfig{Mode: resourceModeClamp,
+				MinRequests: quantities{"cpu": "50m"}, MaxRequests: quantities{"memory": "1Gi"},
+				MinLimits: quantities{"cpu": "100m"}, MaxLimits: quantities{"memory": "2Gi"}},
+			requests:     quantities{"cpu": "10m", "memory": "4Gi"},
+			limits:       quantities{"cpu": "20m", "memory": "8Gi"},
+			wantRequests: quantities{"cpu": "50m", "memory": "1Gi"},
+			wantLimits:   quantities{"cpu": "100m", "memory": "2Gi"},
+		},
+		{
+			name:         "clamp raises the limit to a minimum request above it",
+			policy:       ResourcePolicyConfig{Mode: resourceModeClamp, MinRequests: quantities{"cpu": "500m"}},
+			requests:     quantities{"cpu": "100m"},
+			limits:       quantities{"cpu": "200m"},
+			wantRequests: quantities{"cpu": "500m"},
+			wantLimits:   quantities{"cpu": "500m"},
+		},
+		{
+			name:         "clamp lowers the request to the limit if the limit cannot be raised",
+			policy:       ResourcePolicyConfig{Mode: resourceModeClamp, MaxLimits: quantities{"cpu": "200m"}},
+			requests:     quantities{"cpu": "1"},
+			limits:       quantities{"cpu": "200m"},
+			wantRequests: quantities{"cpu": "200m"},
+			wantLimits:   quantities{"cpu": "200m"},
+		},
+		{
+			name:         "clamp caps the memory limit at the ratio",
+			policy:       ResourcePolicyConfig{Mode: resourceModeClamp, MaxLimitRequestRatio: map[string]float64{"memory": 2}},
+			requests:     quantities{"memory": "64Mi"},
+			limits:       quantities{"memory": "512Mi"},
+			wantRequests: quantities{"memory": "64Mi"},
+			wantLimits:   quantities{"memory": "128Mi"},
+		},
+		{
+			name:         "clamp caps the cpu limit at a fractional ratio",
+			policy:       ResourcePolicyConfig{Mode: resourceModeClamp, MaxLimitRequestRatio: map[string]float64{"cpu": 1.5}},
+			requests:     quantities{"cpu": "250m"},
+			limits:       quantities{"cpu": "2"},
+			wantRequests: quantities{"cpu": "250m"},
+			wantLimits:   quantities{"cpu": "375m"},
+		},
+		{
+			name:         "a limit within the ratio is kept",
+			policy:       ResourcePolicyConfig{Mode: resourceModeClamp, MaxLimitRequestRatio: map[string]float64{"memory": 2}},
+			requests:     quantities{"memory": "64Mi"},
+			limits:       quantities{"memory": "128Mi"},
+			wantRequests: quantities{"memory": "64Mi"},
+			wantLimits:   quantities{"memory": "128Mi"},
+		},
+		{
+			name: "reject reports bounds and ratios without changing them",
+			policy: ResourcePolicyConfig{Mode: resourceModeReject,
+				MinRequests: quantities{"cpu": "50m"}, MaxLimits: quantities{"memory": "1Gi"},
+				MaxLimitRequestRatio: map[string]float64{"cpu": 4}},
+			requests:     quantities{"cpu": "10m", "memory": "64Mi"},
+			limits:       quantities{"cpu": "1", "memory": "2Gi"},
+			wantRequests: quantities{"cpu": "10m", "memory": "64Mi"},
+			wantLimits:   quantities{"cpu": "1", "memory": "2Gi"},
+			wantProblems: []string{"resources.requests.cpu", "resources.limits.memory", "resources.limits.cpu"},
+		},
+		{
+			name: "reject applies defaults and reports only what the container sets",
+			policy: ResourcePolicyConfig{Mode: resourceModeReject,
+				DefaultRequests: quantities{"memory": "64Mi"}, DefaultLimits: quantities{"memory": "256Mi"},
+				MaxRequests: quantities{"cpu": "1"}, MaxLimitRequestRatio: map[string]float64{"memory": 2}},
+			requests:     quantities{"cpu": "2"},
+			wantRequests: quantities{"cpu": "2", "memory": "64Mi"},
+			wantLimits:   quantities{"memory": "128Mi"},
+			wantProblems: []string{"resources.requests.cpu"},
+		},
+		{
+			name:         "reject applies defaults to a container without resources",
+			policy:       ResourcePolicyConfig{Mode: resourceModeReject, DefaultRequests: quantities{"cpu": "100m"}, MinRequests: quantities{"cpu": "100m"}},
+			wantRequests: quantities{"cpu": "100m"},
+			wantLimits:   quantities{},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, problems := newResourcePolicy("resources", tc.policy)
+			if len(problems) > 0 {
+				t.Fatalf("invalid policy: %v", problems)
+			}
+			requirements := v1.ResourceRequirements{Requests: tc.requests.list(), Limits: tc.limits.list()}
+			want, got := p.resolve(requirements)
+
+			if requests := quantitiesOf(want.Requests); !reflect.DeepEqual(requests, tc.wantRequests) {
+				t.Errorf("got requests %v, want %v", requests, tc.wantRequests)
+			}
+			if limits := quantitiesOf(want.Limits); !reflect.DeepEqual(limits, tc.wantLimits) {
+				t.Errorf("got limits %v, want %v", limits, tc.wantLimits)
+			}
+			var fields []string
+			for _, problem := range got {
+				if problem.missing {
+					fields = append(fields, "missing:"+problem.field)
+				} else {
+					fields = append(fields, problem.field)
+				}
+			}
+			if !reflect.DeepEqual(fields, tc.wantProblems) {
+				t.Errorf("got problems %v, want %v", got, tc.wantProblems)
+			}
+			// the container itself must not be changed
+			if !reflect.DeepEqual(quantitiesOf(requirements.Requests), quantitiesOf(tc.requests.list())) {
+				t.Errorf("resolve changed the requests of the container to %v", requirements.Requests)
+			}
+		})
+	}
+}
+
+func TestNewResourcePolicyProblems(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ResourcePolicyConfig
+		want   []string
+	}{
+		{
+			name:   "valid",
+			policy: ResourcePolicyConfig{Mode: resourceModeClamp, DefaultRequests: quantities{"cpu": "100m"}, MinRequests: quantities{"cpu": "50m"}, MaxLimitRequestRatio: map[string]float64{"cpu": 1}},
+		},
+		{
+			name:   "unknown mode",
+			policy: ResourcePolicyConfig{Mode: "strict"},
+			want:   []string{"resources.mode: unknown mode strict"},
+		},
+		{
+			name:   "invalid quantity",
+			policy: ResourcePolicyConfig{MaxLimits: quantities{"memory": "lots"}},
+			want:   []string{"resources.maxLimits[memory]: "},
+		},
+		{
+			name:   "ratio below 1",
+			policy: ResourcePolicyConfig{MaxLimitRequestRatio: map[string]float64{"memory": 0.5}},
+			want:   []string{"resources.maxLimitRequestRatio[memory]: 0.5 is below 1"},
+		},
+		{
+			name:   "minimum above maximum",
+			policy: ResourcePolicyConfig{MinLimits: quantities{"cpu": "2"}, MaxLimits: quantities{"cpu": "1"}},
+			want:   []string{"resources.minLimits[cpu]: 2 is above maxLimits[cpu]: 1"},
+		},
+		{
+			name:   "default out of bounds",
+			policy: ResourcePolicyConfig{DefaultRequests: quantities{"cpu": "10m"}, MinRequests: quantities{"cpu": "50m"}, DefaultLimits: quantities{"memory": "4Gi"}, MaxLimits: quantities{"memory": "1Gi"}},
+			want: []string{"resources.defaultRequests[cpu]: 10m is below minRequests[cpu]: 50m",
+				"resources.defaultLimits[memory]: 4Gi is above maxLimits[memory]: 1Gi"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			p, problems := newResourcePolicy("resources", tc.policy)
+			if len(problems) != len(tc.want) {
+				t.Fatalf("got problems %q, want %q", problems, tc.want)
+			}
+			for i, want := range tc.want {
+				if !strings.HasPrefix(problems[i], want) {
+					t.Errorf("got problem %q, want %q", problems[i], want)
+				}
+			}
+			// an unknown mode must fail safe
+			if tc.policy.Mode == "strict" && p.mode != resourceModeReject {
+				t.Errorf("got mode %v for an unknown mode, want %v", p.mode, resourceModeReject)
+			}
+		})
+	}
+}
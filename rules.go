@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	networkv1beta1 "k8s.io/api/networking/v1beta1"
+)
+
+// rule IDs identify each policy check in config, logs and rejection messages, so they must never be renamed.
+const (
+	ruleDeployDescription    = "DEPLOY-DESCRIPTION"
+	ruleDeploySvcLabel       = "DEPLOY-SVC-LABEL"
+	ruleDeploySvcLabelMatch  = "DEPLOY-SVC-LABEL-MATCH"
+	ruleDeployTemplateLabel  = "DEPLOY-TEMPLATE-SVC-LABEL"
+	ruleDeploySelectorLabel  = "DEPLOY-SELECTOR-SVC-LABEL"
+	ruleDeployImageTag       = "DEPLOY-IMAGE-TAG"
+	ruleDeployRunAsNonRoot   = "DEPLOY-RUN-AS-NON-ROOT"
+	ruleDeploySvcImmutable   = "DEPLOY-SVC-LABEL-IMMUTABLE"
+	ruleDeployResources      = "DEPLOY-RESOURCES"
+	rulePodRunAsNonRoot      = "POD-RUN-AS-NON-ROOT"
+	ruleSvcDescription       = "SVC-DESCRIPTION"
+	ruleSvcLabel             = "SVC-SVC-LABEL"
+	ruleSvcSelector          = "SVC-SELECTOR"
+	ruleSvcSvcImmutable      = "SVC-SVC-LABEL-IMMUTABLE"
+	ruleIngSingleRule        = "ING-SINGLE-RULE"
+	ruleIngHost              = "ING-HOST"
+	ruleIngHostImmutable     = "ING-HOST-IMMUTABLE"
+	ruleIngMergeableType     = "ING-MERGEABLE-TYPE"
+	ruleIngNginxAnnotations  = "ING-NGINX-ANNOTATIONS"
+	ruleIngMinionSinglePath  = "ING-MINION-SINGLE-PATH"
+	ruleIngMinionPathFormat  = "ING-MINION-PATH-FORMAT"
+	ruleIngMinionAnnotations = "ING-MINION-REQUIRED-ANNOTATIONS"
+	ruleIngMinionSslServices = "ING-MINION-SSL-SERVICES"
+	ruleIngMinionLabels      = "ING-MINION-REQUIRED-LABELS"
+	ruleIngMinionSvcLabel    = "ING-MINION-SVC-LABEL-MATCH"
+	ruleIngMinionName        = "ING-MINION-NAME"
+)
+
+// rule is a named policy check. Every check the handlers run is registered as a rule, so that it can be referred to
+// by ID in config, logs and rejection messages.
+type rule struct {
+	ID          string
+	Resource    string
+	Description string
+	// check records a violation for every way the object fails the rule
+	check func(in *ruleInput, v *violations)
+}
+
+// ruleInput is the decoded object a rule is evaluated against, only the field matching the rule's resource is set.
+// Config is the configuration snapshot of the request being evaluated and Namespace the namespace of the request, which
+// the object does not always carry. Old is the object as it was before an UPDATE, it is nil for every other operation,
+// so rules about changes only fire on updates.
+type ruleInput struct {
+	Config    *Config
+	Namespace string
+	Workload  *workload
+	Pod       *corev1.Pod
+	Service   *corev1.Service
+	Ingress   *networkv1beta1.Ingress
+	Old       *ruleInput
+}
+
+// ruleRegistry holds every rule in registration order, which is also the order the rules are evaluated in.
+var ruleRegistry []*rule
+
+// registerRules adds rules to the registry, it is called from the init function of each handler.
+func registerRules(rules ...*rule) {
+	for _, r := range rules {
+		if findRule(r.ID) != nil {
+			panic(fmt.Sprintf("rule %v is registered twice", r.ID))
+		}
+		ruleRegistry = append(ruleRegistry, r)
+	}
+}
+
+// findRule returns the registered rule with the given ID, or nil if there is none.
+func findRule(id string) *rule {
+	for _, r := range ruleRegistry {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// evaluateRules runs every enabled rule registered for the resource against the object.
+func evaluateRules(resource string, in *ruleInput, v *violations) {
+	for _, r := range ruleRegistry {
+		if r.Resource != resource || !in.Config.ruleEnabled(r.ID) {
+			continue
+		}
+		v.rule = r.ID
+		r.check(in, v)
+	}
+	v.rule = ""
+}
+
+// ruleEnabled reports whether the rule is switched on, rules are enabled unless config disables them.
+func (c *Config) ruleEnabled(id string) bool {
+	enabled, ok := c.Rules.Enabled[id]
+	return !ok || enabled
+}
+
+// logRuleConfig logs the state of every rule and warns about rule IDs in the config that do not exist, which are
+// most likely typos that leave a rule in a different state than intended.
+func (c *Config) logRuleConfig() {
+	for _, r := range ruleRegistry {
+		state := "enabled"
+		if !c.ruleEnabled(r.ID) {
+			state = "disabled"
+		}
+		logger.WithFields(logrus.Fields{"rule": r.ID, "resource": r.Resource, "state": state}).Info(r.Description)
+	}
+	for _, id := range c.unknownRuleIDs() {
+		logger.WithField("rule", id).Warn("rule is referenced in the config but does not exist")
+	}
+}
+
+// unknownRuleIDs returns the sorted rule IDs referenced in the rules config that are not registered.
+func (c *Config) unknownRuleIDs() []string {
+	seen := map[string]bool{}
+	check := func(ids map[string]string) {
+		for id := range ids {
+			seen[id] = true
+		}
+	}
+	check(c.Rules.Modes)
+	for _, ns := range c.Rules.Namespaces {
+		check(ns.Modes)
+	}
+	for id := range c.Rules.Enabled {
+		seen[id] = true
+	}
+
+	var unknown []string
+	for id := range seen {
+		if findRule(id) == nil {
+			unknown = append(unknown, id)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// rule enforcement modes
+const (
+	// modeEnforce denies the object
+	modeEnforce = "enforce"
+	// modeWarn allows the object but returns a warning to the client
+	modeWarn = "warn"
+	// modeAudit allows the object and only logs the violation
+	modeAudit = "audit"
+)
+
+// RulesConfig selects how violations are handled. The most specific setting wins: a rule mode for the longest matching
+// namespace prefix, then that namespace's default mode, then the global rule mode, then the global default mode.
+// Enabled switches individual rules off (false) or back on (true), a profile can re-enable a rule disabled globally.
+type RulesConfig struct {
+	Mode       string
+	Modes      map[string]string
+	Namespaces map[string]NamespaceRulesConfig
+	Enabled    map[string]bool
+}
+
+// NamespaceRulesConfig overrides rule modes for namespaces starting with a given prefix.
+type NamespaceRulesConfig struct {
+	Mode  string
+	Modes map[string]string
+}
+
+// ruleMode returns the enforcement mode of the rule for objects in the given namespace.
+func (c *Config) ruleMode(ns string, rule string) string {
+	rules := c.Rules
+	mode := ""
+
+	// find the longest namespace prefix with overrides
+	prefix, _ := c.compiled().ruleNamespaces.longestPrefix(ns)
+	if nsRules, ok := rules.Namespaces[prefix]; ok && prefix != "" {
+		if mode = nsRules.Modes[rule]; mode == "" {
+			mode = nsRules.Mode
+		}
+	}
+	if mode == "" {
+		if mode = rules.Modes[rule]; mode == "" {
+			mode = rules.Mode
+		}
+	}
+
+	switch mode {
+	case modeEnforce, modeWarn, modeAudit:
+		return mode
+	case "":
+		return modeEnforce
+	default:
+		// fail safe, an unknown mode must never weaken the policy
+		logger.WithFields(logrus.Fields{"rule": rule, "mode": mode, "namespace": ns}).Error("unknown mode configured, enforcing")
+		return modeEnforce
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRuleMode(t *testing.T) {
+	cfg := &Config{Rules: RulesConfig{
+		Mode:  modeWarn,
+		Modes: map[string]string{"DEPLOY-IMAGE-TAG": modeAudit, "DEPLOY-DESCRIPTION": "bogus"},
+		Namespaces: map[string]NamespaceRulesConfig{
+			"tools-":      {Mode: modeEnforce},
+			"tools-prod-": {Modes: map[string]string{"DEPLOY-IMAGE-TAG": modeEnforce}},
+		},
+	}}
+	tests := []struct {
+		name      string
+		namespace string
+		rule      string
+		want      string
+	}{
+		{name: "global mode", namespace: "apps-dev", rule: "DEPLOY-SVC-LABEL", want: modeWarn},
+		{name: "global rule mode", namespace: "apps-dev", rule: "DEPLOY-IMAGE-TAG", want: modeAudit},
+		{name: "unknown mode is enforced", namespace: "apps-dev", rule: "DEPLOY-DESCRIPTION", want: modeEnforce},
+		{name: "namespace mode", namespace: "tools-dev", rule: "DEPLOY-IMAGE-TAG", want: modeEnforce},
+		{name: "namespace rule mode of the longest prefix", namespace: "tools-prod-a", rule: "DEPLOY-IMAGE-TAG", want: modeEnforce},
+		{name: "longest prefix falls back to the global modes", namespace: "tools-prod-a", rule: "DEPLOY-SVC-LABEL", want: modeWarn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.ruleMode(tt.namespace, tt.rule); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := (&Config{}).ruleMode("tools-dev", "DEPLOY-IMAGE-TAG"); got != modeEnforce {
+		t.Errorf("got %v without rules config, want %v", got, modeEnforce)
+	}
+}
+
+func TestApplyRuleModes(t *testing.T) {
+	// admit reports a violation of DEPLOY-IMAGE-TAG and DEPLOY-SVC-LABEL
+	admit := func(cfg *Config, req *admissionRequest) ([]patchOperation, error) {
+		v := newViolations("deployment", "api", req.Namespace)
+		v.rule = ruleDeployImageTag
+		v.invalid("spec.template.spec.containers[0].image", "image tag latest")
+		v.rule = ruleDeploySvcLabel
+		v.missing("metadata.labels.svc", "metadata.labels.svc is missing")
+		return nil, v.err()
+	}
+	tests := []struct {
+		name         string
+		modes        map[string]string
+		wantDecision string
+		wantEnforced []string
+		wantWarnings int
+	}{
+		{
+			name:         "enforce",
+			modes:        map[string]string{},
+			wantDecision: decisionDenied,
+			wantEnforced: []string{ruleDeployImageTag, ruleDeploySvcLabel},
+		},
+		{
+			name:         "warn",
+			modes:        map[string]string{ruleDeployImageTag: modeWarn, ruleDeploySvcLabel: modeWarn},
+			wantDecision: decisionAllowed,
+			wantWarnings: 2,
+		},
+		{
+			name:         "audit",
+			modes:        map[string]string{ruleDeployImageTag: modeAudit, ruleDeploySvcLabel: modeAudit},
+			wantDecision: decisionAllowed,
+		},
+		{
+			name:         "mixed modes only deny for the enforced rule",
+			modes:        map[string]string{ruleDeployImageTag: modeWarn, ruleDeploySvcLabel: modeEnforce},
+			wantDecision: decisionDenied,
+			wantEnforced: []string{ruleDeploySvcLabel},
+			wantWarnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{Rules: RulesConfig{Modes: tt.modes}}
+			req := &admissionRequest{UID: "test", Namespace: "tools-dev", Operation: operationCreate}
+			req.log = requestLogger(admitPath, req)
+			v := evaluateRequest(cfg, admit, req)
+			if v.decision != tt.wantDecision {
+				t.Errorf("got decision %v, want %v", v.decision, tt.wantDecision)
+			}
+			// every violation is kept for the decision record, with its mode
+			if len(v.violations) != 2 {
+				t.Fatalf("got violations %v, want 2", v.violations)
+			}
+			for _, violation := range v.violations {
+				if want := cfg.ruleMode(req.Namespace, violation.Rule); violation.Mode != want {
+					t.Errorf("got mode %v of %v, want %v", violation.Mode, violation.Rule, want)
+				}
+			}
+			var enforced []string
+			if v.denial != nil {
+				for _, violation := range v.denial.violations {
+					enforced = append(enforced, violation.Rule)
+				}
+			}
+			if !reflect.DeepEqual(enforced, tt.wantEnforced) {
+				t.Errorf("got enforced rules %v, want %v", enforced, tt.wantEnforced)
+			}
+			if len(v.warnings) != tt.wantWarnings {
+				t.Errorf("got warnings %v, want %d", v.warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ServerConfig holds the HTTP server timeouts as duration strings such as "10s". The read, write and idle timeouts are
+// applied when the server starts, the drain period and shutdown timeout are read from the config in effect when the
+// pod is told to stop. The buffered audit records are written for up to the shutdown timeout once the server has shut
+// down, so the drain period plus twice the shutdown timeout must stay below terminationGracePeriodSeconds.
+type ServerConfig struct {
+	// ReadTimeout limits reading a whole AdmissionReview request
+	ReadTimeout string
+	// WriteTimeout limits handling a request and writing the response
+	WriteTimeout string
+	// IdleTimeout is how long an idle keep-alive connection from the apiserver is kept open
+	IdleTimeout string
+	// DrainPeriod is how long requests are still served after SIGTERM while readiness reports not ready, so that the
+	// endpoint is removed from the Service before the server stops accepting connections
+	DrainPeriod string
+	// ShutdownTimeout is how long in-flight requests may take to complete once the server stops accepting connections
+	ShutdownTimeout string
+}
+
+// server timeouts used when the config does not set them
+const (
+	defaultReadTimeout     = 10 * time.Second
+	defaultWriteTimeout    = 10 * time.Second
+	defaultIdleTimeout     = 60 * time.Second
+	defaultDrainPeriod     = 10 * time.Second
+	defaultShutdownTimeout = 15 * time.Second
+)
+
+// serverTimeouts are the parsed durations of a ServerConfig.
+type serverTimeouts struct {
+	read     time.Duration
+	write    time.Duration
+	idle     time.Duration
+	drain    time.Duration
+	shutdown time.Duration
+}
+
+// timeouts parses the configured durations. A missing duration uses its default, an invalid one uses its default and
+// is reported in the error.
+func (s ServerConfig) timeouts() (serverTimeouts, error) {
+	var problems []string
+	parse := func(name string, value string, def time.Duration) time.Duration {
+		if value == "" {
+			return def
+		}
+		d, err := time.ParseDuration(value)
+		if err == nil && d < 0 {
+			err = errors.New("must not be negative")
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("server.%v: %v", name, err))
+			return def
+		}
+		return d
+	}
+
+	t := serverTimeouts{
+		read:     parse("readTimeout", s.ReadTimeout, defaultReadTimeout),
+		write:    parse("writeTimeout", s.WriteTimeout, defaultWriteTimeout),
+		idle:     parse("idleTimeout", s.IdleTimeout, defaultIdleTimeout),
+		drain:    parse("drainPeriod", s.DrainPeriod, defaultDrainPeriod),
+		shutdown: parse("shutdownTimeout", s.ShutdownTimeout, defaultShutdownTimeout),
+	}
+	if len(problems) > 0 {
+		return t, errors.New(strings.Join(problems, "; "))
+	}
+	return t, nil
+}
+
+// serveUntilSignalled runs the webhook server until SIGTERM or SIGINT. On a signal readiness is switched off and
+// requests are served for the drain period, then the server is shut down, waiting for in-flight requests up to the
+// shutdown timeout.
+func serveUntilSignalled(server *http.Server, ready *readiness) {
+	errs := make(chan error, 1)
+	go func() {
+		// the certificate is served by TLSConfig.GetCertificate, so no files are passed here
+		errs <- server.ListenAndServeTLS("", "")
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errs:
+		logger.WithError(err).Fatal("webhook server failed")
+	case sig := <-signals:
+		logger.Infof("Received %v, draining", sig)
+	}
+
+	t, _ := loadedConfig().Server.timeouts()
+	ready.drain()
+	logger.Infof("Serving for the %v drain period while the endpoint is removed from the service", t.drain)
+	time.Sleep(t.drain)
+
+	logger.Infof("Shutting down, waiting up to %v for in-flight requests", t.shutdown)
+	ctx, cancel := context.WithTimeout(context.Background(), t.shutdown)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		logger.WithError(err).Error("Shutdown did not complete")
+	}
+	// no more decisions are made, write the audit records still buffered
+	auditTrail.close(t.shutdown)
+	logger.Info("Shutdown complete")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// violation is a single policy check that an object failed.
+type violation struct {
+	Rule    string           `json:"rule"`
+	Mode    string           `json:"mode"`
+	Type    metav1.CauseType `json:"type"`
+	Field   string           `json:"field"`
+	Message string           `json:"message"`
+}
+
+// String returns the violation message prefixed with its rule ID.
+func (v violation) String() string {
+	return fmt.Sprintf("[%v] %v", v.Rule, v.Message)
+}
+
+// violations collects every policy check an object fails, so that the developer sees all of them in one rejection
+// instead of having to re-apply the object once per problem.
+type violations struct {
+	kind      string
+	name      string
+	namespace string
+	// rule is the ID of the rule currently being evaluated, see evaluateRules
+	rule string
+	list []violation
+}
+
+func newViolations(kind string, name string, namespace string) *violations {
+	return &violations{kind: kind, name: name, namespace: namespace}
+}
+
+// missing records a required field that is not present on the object.
+func (v *violations) missing(field string, format string, args ...interface{}) {
+	v.add(metav1.CauseTypeFieldValueRequired, field, fmt.Sprintf(format, args...))
+}
+
+// invalid records a field whose value does not meet the standard.
+func (v *violations) invalid(field string, format string, args ...interface{}) {
+	v.add(metav1.CauseTypeFieldValueInvalid, field, fmt.Sprintf(format, args...))
+}
+
+func (v *violations) add(causeType metav1.CauseType, field string, msg string) {
+	v.list = append(v.list, violation{Rule: v.rule, Type: causeType, Field: field, Message: msg})
+}
+
+// err returns nil if no violations were recorded, otherwise a violationError describing all of them.
+func (v *violations) err() error {
+	if len(v.list) == 0 {
+		return nil
+	}
+	return &violationError{kind: v.kind, name: v.name, namespace: v.namespace, violations: v.list}
+}
+
+// violationError is returned by an admitFunc when an object fails one or more policy checks. Whether the object is
+// actually denied depends on the mode of each rule, see applyRuleModes.
+type violationError struct {
+	kind       string
+	name       string
+	namespace  string
+	violations []violation
+}
+
+func (e *violationError) Error() string {
+	msgs := make([]string, 0, len(e.violations))
+	for _, v := range e.violations {
+		msgs = append(msgs, v.String())
+	}
+	return fmt.Sprintf("Rejected %v name: %v namespace: %v. %d policy violation(s): %v", e.kind, e.name, e.namespace, len(e.violations), strings.Join(msgs, "; "))
+}
+
+// status converts the violations into the metav1.Status returned to the apiserver, with one cause per violation so
+// that kubectl can show the offending field paths.
+func (e *violationError) status() *metav1.Status {
+	causes := make([]metav1.StatusCause, 0, len(e.violations))
+	for _, v := range e.violations {
+		causes = append(causes, metav1.StatusCause{Type: v.Type, Message: v.String(), Field: v.Field})
+	}
+	return &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: e.Error(),
+		Reason:  metav1.StatusReasonInvalid,
+		Code:    http.StatusUnprocessableEntity,
+		Details: &metav1.StatusDetails{
+			Name:   e.name,
+			Kind:   e.kind,
+			Causes: causes,
+		},
+	}
+}
+
+// applyRuleModes resolves the configured mode of every violation in err for the given namespace. Audited violations
+// are only logged and warned violations are returned as warnings for the client. The returned error only contains the
+// enforced violations, it is nil if there are none. Errors that are not policy violations are returned unchanged.
+func applyRuleModes(cfg *Config, req *admissionRequest, err error) ([]string, error) {
+	verr, ok := err.(*violationError)
+	if !ok {
+		return nil, err
+	}
+
+	var enforced []violation
+	var warnings []string
+	for i := range verr.violations {
+		// the mode is recorded on the violation itself so that the metrics can tell enforced and warned rules apart
+		verr.violations[i].Mode = cfg.ruleMode(req.Namespace, verr.violations[i].Rule)
+		v := verr.violations[i]
+		entry := req.log.WithFields(logrus.Fields{"rule": v.Rule, "mode": v.Mode, "field": v.Field})
+		switch v.Mode {
+		case modeAudit:
+			entry.Info("Audited: " + v.Message)
+		case modeWarn:
+			entry.Warn("Warned: " + v.Message)
+			warnings = append(warnings, fmt.Sprintf("%v %v: %v", verr.kind, verr.name, v))
+		default:
+			entry.Warn("Rejected: " + v.Message)
+			enforced = append(enforced, v)
+		}
+	}
+
+	if len(enforced) == 0 {
+		return warnings, nil
+	}
+	return warnings, &violationError{kind: verr.kind, name: verr.name, namespace: verr.namespace, violations: enforced}
+}
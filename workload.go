@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// workload is an object that runs pods from an embedded pod template. The workload rules and mutations are written
+// against it, so that every kind of workload is held to the same policy as a Deployment.
+type workload struct {
+	kind string
+	meta *metav1.ObjectMeta
+	// selector is only checked if hasSelector is set, the selector of Jobs and CronJobs is generated
+	selector    *metav1.LabelSelector
+	hasSelector bool
+	template    *v1.PodTemplateSpec
+	// jobMeta is the metadata the Jobs of a CronJob are created with, it is nil for every other kind
+	jobMeta *metav1.ObjectMeta
+	// templatePath is the path of the pod template in the object, such as spec, jobTemplate, spec, template
+	templatePath []string
+}
+
+// workloadKind is a kind of workload the webhook admits.
+type workloadKind struct {
+	kind     metav1.GroupVersionKind
+	resource metav1.GroupVersionResource
+	// decode decodes an object of the kind
+	decode func(raw []byte) (*workload, error)
+	// sampleSpec is the spec of the sample object around the sample pod template, see workloadSample
+	sampleSpec string
+	alias      string
+}
+
+// workloadKinds are the kinds admitted by admitWorkload.
+var workloadKinds = []*workloadKind{
+	{
+		kind:     metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "Deployment"},
+		resource: deployAppsResource,
+		decode: func(raw []byte) (*workload, error) {
+			d := &appsv1.Deployment{}
+			if err := decodeWorkloadObject(raw, d, "deployment"); err != nil {
+				return nil, err
+			}
+			return newWorkload("Deployment", &d.ObjectMeta, d.Spec.Selector, &d.Spec.Template), nil
+		},
+		sampleSpec: `{"selector":{"matchLabels":{"svc":"admit-self-check"}},"template":%v}`,
+		alias:      "/admit-deploy",
+	},
+	{
+		kind:     metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "StatefulSet"},
+		resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"},
+		decode: func(raw []byte) (*workload, error) {
+			s := &appsv1.StatefulSet{}
+			if err := decodeWorkloadObject(raw, s, "statefulset"); err != nil {
+				return nil, err
+			}
+			return newWorkload("StatefulSet", &s.ObjectMeta, s.Spec.Selector, &s.Spec.Template), nil
+		},
+		sampleSpec: `{"serviceName":"admit-self-check","selector":{"matchLabels":{"svc":"admit-self-check"}},"template":%v}`,
+	},
+	{
+		kind:     metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "DaemonSet"},
+		resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "daemonsets"},
+		decode: func(raw []byte) (*workload, error) {
+			d := &appsv1.DaemonSet{}
+			if err := decodeWorkloadObject(raw, d, "daemonset"); err != nil {
+				return nil, err
+			}
+			return newWorkload("DaemonSet", &d.ObjectMeta, d.Spec.Selector, &d.Spec.Template), nil
+		},
+		sampleSpec: `{"selector":{"matchLabels":{"svc":"admit-self-check"}},"template":%v}`,
+	},
+	{
+		kind:     metav1.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+		resource: metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "replicasets"},
+		decode: func(raw []byte) (*workload, error) {
+			r := &appsv1.ReplicaSet{}
+			if err := decodeWorkloadObject(raw, r, "replicaset"); err != nil {
+				return nil, err
+			}
+			return newWorkload("ReplicaSet", &r.ObjectMeta, r.Spec.Selector, &r.Spec.Template), nil
+		},
+		sampleSpec: `{"selector":{"matchLabels":{"svc":"admit-self-check"}},"template":%v}`,
+	},
+	{
+		kind:     metav1.GroupVersionKind{Group: "batch", Version: "v1", Kind: "Job"},
+		resource: metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"},
+		decode: func(raw []byte) (*workload, error) {
+			j := &batchv1.Job{}
+			if err := decodeWorkloadObject(raw, j, "job"); err != nil {
+				return nil, err
+			}
+			w := newWorkload("Job", &j.ObjectMeta, j.Spec.Selector, &j.Spec.Template)
+			w.hasSelector = false
+			return w, nil
+		},
+		sampleSpec: `{"template":%v}`,
+	},
+	{
+		kind:     metav1.GroupVersionKind{Group: "batch", Version: "v1beta1", Kind: "CronJob"},
+		resource: metav1.GroupVersionResource{Group: "batch", Version: "v1beta1", Resource: "cronjobs"},
+		decode: func(raw []byte) (*workload, error) {
+			c := &batchv1beta1.CronJob{}
+			if err := decodeWorkloadObject(raw, c, "cronjob"); err != nil {
+				return nil, err
+			}
+			w := newWorkload("CronJob", &c.ObjectMeta, c.Spec.JobTemplate.Spec.Selector, &c.Spec.JobTemplate.Spec.Template)
+			w.hasSelector = false
+			w.jobMeta = &c.Spec.JobTemplate.ObjectMeta
+			w.templatePath = []string{"spec", "jobTemplate", "spec", "template"}
+			return w, nil
+		},
+		sampleSpec: `{"schedule":"@daily","jobTemplate":{"metadata":{"labels":{"svc":"admit-self-check"},"annotations":{"description":"readiness self-check"}},"spec":{"template":%v}}}`,
+	},
+}
+
+// newWorkload returns a workload with a selector and its pod template at spec.template, which is where every kind but
+// CronJob has it.
+func newWorkload(kind string, meta *metav1.ObjectMeta, selector *metav1.LabelSelector, template *v1.PodTemplateSpec) *workload {
+	return &workload{
+		kind:         kind,
+		meta:         meta,
+		selector:     selector,
+		hasSelector:  true,
+		template:     template,
+		templatePath: []string{"spec", "template"},
+	}
+}
+
+// decodeWorkloadObject decodes raw into obj, name is the kind as it is named in the error.
+func decodeWorkloadObject(raw []byte, obj runtime.Object, name string) error {
+	if _, _, err := universalDeserializer.Decode(raw, nil, obj); err != nil {
+		return fmt.Errorf("could not deserialize %v object: %v", name, err)
+	}
+	return nil
+}
+
+// workloadKindOf returns the workload kind of the group and kind, or nil if it is not a workload. Workload kinds are
+// matched by group, not version.
+func workloadKindOf(group string, kind string) *workloadKind {
+	for _, k := range workloadKinds {
+		if k.kind.Group == group && k.kind.Kind == kind {
+			return k
+		}
+	}
+	return nil
+}
+
+// decodeWorkload decodes a workload of any kind, the kind is read from the object.
+func decodeWorkload(raw []byte) (*workload, error) {
+	var typeMeta metav1.TypeMeta
+	if err := json.Unmarshal(raw, &typeMeta); err != nil {
+		return nil, fmt.Errorf("could not deserialize workload object: %v", err)
+	}
+	gv, err := schema.ParseGroupVersion(typeMeta.APIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize workload object: %v", err)
+	}
+	k := workloadKindOf(gv.Group, typeMeta.Kind)
+	if k == nil {
+		return nil, fmt.Errorf("%v %v is not a workload kind", typeMeta.APIVersion, typeMeta.Kind)
+	}
+	return k.decode(raw)
+}
+
+// decodeWorkloadInput decodes a workload for the workload rules.
+func decodeWorkloadInput(raw []byte) (*ruleInput, error) {
+	w, err := decodeWorkload(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &ruleInput{Workload: w}, nil
+}
+
+// generatedOwners are the kinds whose controller generates workloads of another kind, and names them after itself.
+var generatedOwners = map[string]metav1.GroupKind{
+	"ReplicaSet": {Group: "apps", Kind: "Deployment"},
+	"Job":        {Group: "batch", Kind: "CronJob"},
+}
+
+// generatedOwner returns the controller owner reference of a ReplicaSet created by a Deployment or a Job created by a
+// CronJob, which names it after itself with a generated suffix, or nil for every other workload. The reference is set
+// by the client and not verified.
+func (w *workload) generatedOwner() *metav1.OwnerReference {
+	want, ok := generatedOwners[w.kind]
+	owner := metav1.GetControllerOf(w.meta)
+	if !ok || owner == nil || !strings.HasPrefix(w.meta.Name, owner.Name+"-") {
+		return nil
+	}
+	gv, err := schema.ParseGroupVersion(owner.APIVersion)
+	if err != nil || gv.Group != want.Group || owner.Kind != want.Kind {
+		return nil
+	}
+	return owner
+}
+
+// field returns the dotted path of a field of the pod template, as it is reported in violations.
+func (w *workload) field(path ...string) string {
+	return strings.Join(append(append([]string{}, w.templatePath...), path...), ".")
+}
+
+// path returns the path of a field of the pod template, as it is given to the patch builder.
+func (w *workload) path(path ...string) []string {
+	return append(append([]string{}, w.templatePath...), path...)
+}
+
+// containerPath returns the path of a field of the i-th container of the pod template.
+func (w *workload) containerPath(i int, field ...string) []string {
+	return w.path(append([]string{"spec", "containers", strconv.Itoa(i)}, field...)...)
+}
+
+// workloadSample returns the sample object of the kind, which passes every workload rule.
+func workloadSample(k *workloadKind) string {
+	template := `{"metadata":{"labels":{"svc":"admit-self-check"}},"spec":{"restartPolicy":"%v","containers":[{"name":"app","image":"alpine:3.12"}]}}`
+	// the pods of Jobs must not be restarted in place
+	restartPolicy := "Always"
+	if k.kind.Group == "batch" {
+		restartPolicy = "Never"
+	}
+	template = fmt.Sprintf(template, restartPolicy)
+	apiVersion := schema.GroupVersion{Group: k.kind.Group, Version: k.kind.Version}.String()
+	return fmt.Sprintf(`{"apiVersion":%q,"kind":%q,"metadata":{"name":"admit-self-check","labels":{"svc":"admit-self-check"},"annotations":{"description":"readiness self-check"}},"spec":%v}`,
+		apiVersion, k.kind.Kind, fmt.Sprintf(k.sampleSpec, template))
+}
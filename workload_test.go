@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testCronJob = `{"apiVersion":"batch/v1beta1","kind":"CronJob",
+	"metadata":{"name":"report","namespace":"tools-dev","labels":{"svc":"report"},"annotations":{"description":"nightly report"}},
+	"spec":{"schedule":"@daily","jobTemplate":{%v"spec":{"template":{"metadata":{"labels":{"svc":"report"}},
+		"spec":{"restartPolicy":"Never","containers":[{"name":"app","image":"alpine:3.12"}]}}}}}}`
+
+// admitTestWorkload admits raw as a CREATE of the given workload kind in the tools-dev namespace.
+func admitTestWorkload(t *testing.T, cfg *Config, group string, kind string, raw []byte) ([]patchOperation, error) {
+	t.Helper()
+	k := workloadKindOf(group, kind)
+	if k == nil {
+		t.Fatalf("%v is not a workload kind", kind)
+	}
+	req := &admissionRequest{
+		UID:       "test",
+		Kind:      k.kind,
+		Resource:  k.resource,
+		Name:      "test",
+		Namespace: "tools-dev",
+		Operation: operationCreate,
+	}
+	req.Object.Raw = raw
+	req.log = requestLogger(admitPath, req)
+	return admitWorkload(cfg, req)
+}
+
+// applyTestPatch applies the patch operations to raw.
+func applyTestPatch(t *testing.T, raw []byte, patches []patchOperation) []byte {
+	t.Helper()
+	if len(patches) == 0 {
+		return raw
+	}
+	ops, err := json.Marshal(patches)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := jsonpatch.DecodePatch(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patched, err := patch.Apply(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patched
+}
+
+// generatedJob returns the Job the CronJob controller creates from the CronJob raw.
+func generatedJob(t *testing.T, raw []byte) []byte {
+	t.Helper()
+	c := &batchv1beta1.CronJob{}
+	if err := json.Unmarshal(raw, c); err != nil {
+		t.Fatal(err)
+	}
+	j := &batchv1.Job{
+		TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "Job"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        c.Name + "-27000000",
+			Namespace:   c.Namespace,
+			Labels:      c.Spec.JobTemplate.Labels,
+			Annotations: c.Spec.JobTemplate.Annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(c, batchv1beta1.SchemeGroupVersion.WithKind("CronJob")),
+			},
+		},
+		Spec: c.Spec.JobTemplate.Spec,
+	}
+	out, err := json.Marshal(j)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestCronJobGeneratedJobs(t *testing.T) {
+	cfg := &Config{MonitorNamespaces: []string{"tools-"}}
+	tests := []struct {
+		name        string
+		jobTemplate string
+		// wantErr is a field the CronJob is rejected for, empty if it is admitted along with its Jobs
+		wantErr string
+	}{
+		{
+			name:        "job template metadata is set",
+			jobTemplate: `"metadata":{"labels":{"svc":"report"},"annotations":{"description":"nightly report"}},`,
+		},
+		{
+			name:    "job template metadata is missing",
+			wantErr: "spec.jobTemplate.metadata.labels.svc",
+		},
+		{
+			name:        "job template description is missing",
+			jobTemplate: `"metadata":{"labels":{"svc":"report"}},`,
+			wantErr:     "spec.jobTemplate.metadata.annotations.description",
+		},
+		{
+			name:        "job template svc label does not match",
+			jobTemplate: `"metadata":{"labels":{"svc":"other"},"annotations":{"description":"nightly report"}},`,
+			wantErr:     "spec.jobTemplate.metadata.labels.svc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte(strings.Replace(testCronJob, "%v", tt.jobTemplate, 1))
+			patches, err := admitTestWorkload(t, cfg, "batch", "CronJob", raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one about %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cronjob: %v", err)
+			}
+
+			// the Job is created from the CronJob as it was admitted, patches included
+			job := generatedJob(t, applyTestPatch(t, raw, patches))
+			patches, err = admitTestWorkload(t, cfg, "batch", "Job", job)
+			if err != nil {
+				t.Fatalf("job: %v", err)
+			}
+			if len(patches) > 0 {
+				t.Errorf("job: got patches %v, want none", patches)
+			}
+		})
+	}
+}
+
+func TestExemptDeploymentReplicaSets(t *testing.T) {
+	cfg := &Config{MonitorNamespaces: []string{"tools-"}, ExemptDeployments: []string{"tools-dev/api"}}
+	tests := []struct {
+		name       string
+		rsName     string
+		owner      string
+		wantExempt bool
+	}{
+		{name: "replicaset of an exempt deployment", rsName: "api-5d8f7c9b6", owner: "api", wantExempt: true},
+		{name: "replicaset of another deployment", rsName: "web-5d8f7c9b6", owner: "web"},
+		{name: "replicaset not named after its owner", rsName: "other", owner: "api"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the replicaset has none of the required metadata, it is only admitted if it is exempt
+			raw := []byte(`{"apiVersion":"apps/v1","kind":"ReplicaSet","metadata":{"name":"` + tt.rsName + `","namespace":"tools-dev",
+				"ownerReferences":[{"apiVersion":"apps/v1","kind":"Deployment","name":"` + tt.owner + `","uid":"1","controller":true}]},
+				"spec":{"template":{"spec":{"containers":[{"name":"app","image":"alpine:3.12"}]}}}}`)
+			patches, err := admitTestWorkload(t, cfg, "apps", "ReplicaSet", raw)
+			if exempt := err == nil && len(patches) == 0; exempt != tt.wantExempt {
+				t.Errorf("got exempt %v, want %v: %v %v", exempt, tt.wantExempt, err, patches)
+			}
+		})
+	}
+}
+
+func TestGeneratedWorkloadsAreNotPatched(t *testing.T) {
+	cfg := &Config{MonitorNamespaces: []string{"tools-"}}
+	const replicaSet = `{"apiVersion":"apps/v1","kind":"ReplicaSet","metadata":{"name":%q,"namespace":"tools-dev",
+		"labels":{"svc":"api"},"annotations":{"description":"api"}%v},"spec":{"selector":{"matchLabels":{"svc":"api"}},
+		"template":{"metadata":{"labels":{"svc":"api"}},"spec":{"containers":[{"name":"app","image":%q}]}}}}`
+	const owner = `,"ownerReferences":[{"apiVersion":"apps/v1","kind":"Deployment","name":"api","uid":"1","controller":true}]`
+	tests := []struct {
+		name        string
+		rsName      string
+		owner       string
+		image       string
+		wantPatches bool
+		wantErr     bool
+	}{
+		{name: "replicaset created by a deployment", rsName: "api-5d8f7c9b6", owner: owner, image: "alpine:3.12"},
+		{name: "replicaset created by a deployment is still validated", rsName: "api-5d8f7c9b6", owner: owner, image: "alpine:latest", wantErr: true},
+		{name: "replicaset created directly", rsName: "api", image: "alpine:3.12", wantPatches: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw := []byte(fmt.Sprintf(replicaSet, tt.rsName, tt.owner, tt.image))
+			patches, err := admitTestWorkload(t, cfg, "apps", "ReplicaSet", raw)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if (len(patches) > 0) != tt.wantPatches {
+				t.Errorf("got patches %v, want patches %v", patches, tt.wantPatches)
+			}
+		})
+	}
+}
+
+func TestWorkloadTemplatePaths(t *testing.T) {
+	cfg := &Config{MonitorNamespaces: []string{"tools-"}}
+	tests := []struct {
+		group, kind string
+		want        string
+	}{
+		{group: "apps", kind: "Deployment", want: "/spec/template"},
+		{group: "apps", kind: "StatefulSet", want: "/spec/template"},
+		{group: "apps", kind: "DaemonSet", want: "/spec/template"},
+		{group: "apps", kind: "ReplicaSet", want: "/spec/template"},
+		{group: "batch", kind: "Job", want: "/spec/template"},
+		{group: "batch", kind: "CronJob", want: "/spec/jobTemplate/spec/template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			k := workloadKindOf(tt.group, tt.kind)
+			if k == nil {
+				t.Fatalf("%v is not a workload kind", tt.kind)
+			}
+			// the sample has neither a security context nor the TZ variable, every patch is inside the pod template
+			patches, err := admitTestWorkload(t, cfg, tt.group, tt.kind, []byte(workloadSample(k)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(patches) == 0 {
+				t.Fatal("got no patches")
+			}
+			for _, p := range patches {
+				if !strings.HasPrefix(p.Path, tt.want+"/spec/") {
+					t.Errorf("got patch path %v, want it in %v", p.Path, tt.want)
+				}
+			}
+
+			// violations are reported at the dotted template path
+			w, err := decodeWorkload([]byte(workloadSample(k)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.Replace(strings.TrimPrefix(tt.want, "/"), "/", ".", -1) + ".spec.securityContext"
+			if got := w.field("spec", "securityContext"); got != want {
+				t.Errorf("got field %v, want %v", got, want)
+			}
+		})
+	}
+}